@@ -0,0 +1,66 @@
+package pinge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+)
+
+func NewAdminHandler(registry *Registry, inspector *Inspector) http.Handler {
+	mux := http.NewServeMux()
+
+	if inspector != nil {
+		mux.Handle("/inspect/", inspector.Handler())
+	}
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		statuses := []ClientStatus{}
+		for _, c := range registry.Clients() {
+			statuses = append(statuses, c.Status())
+		}
+
+		writeJSON(w, statuses)
+	})
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		connections := []ConnectionInfo{}
+		for _, c := range registry.Clients() {
+			connections = append(connections, c.Connections()...)
+		}
+
+		writeJSON(w, connections)
+	})
+
+	mux.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		topologies := []TopologyStatus{}
+		for _, c := range registry.Clients() {
+			topologies = append(topologies, c.Topology())
+		}
+
+		writeJSON(w, topologies)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, registry.Clients())
+	})
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,101 @@
+package pinge
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s answered %s", url, res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	registry := NewRegistry()
+
+	admin := httptest.NewServer(NewAdminHandler(registry, nil))
+	t.Cleanup(admin.Close)
+
+	go InitServiceTarget(ctx, "echo", "token", newEchoServer(t), []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithRegistry(registry),
+	})
+
+	if err := gate.WaitConnected(ctx, "echo", true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gate.Dial(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []ClientStatus
+	getJSON(t, admin.URL+"/status", &statuses)
+
+	if len(statuses) != 1 {
+		t.Fatalf("got %d statuses, want 1", len(statuses))
+	}
+
+	status := statuses[0]
+	if status.Service != "echo" || status.URI != gate.URI("echo") || status.Region != "local" ||
+		status.Gate != gate.PrimaryAddress() || status.ConnectedSince.IsZero() || status.Reconnects != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	var connections []ConnectionInfo
+	getJSON(t, admin.URL+"/connections", &connections)
+
+	if len(connections) != 1 {
+		t.Fatalf("got %d connections, want 1", len(connections))
+	}
+
+	info := connections[0]
+	if info.Service != "echo" || info.GateAddr == "" || info.BytesIn != 4 || info.BytesOut != 4 || info.Age <= 0 {
+		t.Fatalf("unexpected connection %+v", info)
+	}
+
+	var topologies []TopologyStatus
+	getJSON(t, admin.URL+"/topology", &topologies)
+
+	if len(topologies) != 1 || len(topologies[0].Regions) != 1 || !topologies[0].Regions[0].Selected ||
+		len(topologies[0].Regions[0].Gates) != 1 || topologies[0].Regions[0].Gates[0].Busy {
+		t.Fatalf("unexpected topology %+v", topologies)
+	}
+
+	conn.Close()
+
+	waitFor(t, func() bool {
+		getJSON(t, admin.URL+"/connections", &connections)
+		return len(connections) == 0
+	}, "closed connection to be unlisted")
+}
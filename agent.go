@@ -0,0 +1,319 @@
+package pinge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tunnelRestartDelay    = time.Second
+	maxTunnelRestartDelay = 30 * time.Second
+)
+
+// Agent runs the tunnels of an AgentConfig and applies new configs to them
+// without touching the tunnels whose settings did not change.
+type Agent struct {
+	ctx     context.Context
+	options []ClientOption
+
+	mu       sync.Mutex
+	defaults AgentConfig
+	config   *AgentConfig
+	session  *Session
+	tunnels  map[string]*runningTunnel
+	wg       sync.WaitGroup
+}
+
+type runningTunnel struct {
+	config TunnelConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type ConfigChanges struct {
+	Started   []string
+	Stopped   []string
+	Restarted []string
+	Unchanged []string
+}
+
+func (c ConfigChanges) String() string {
+	return fmt.Sprintf("started [%s], stopped [%s], restarted [%s], unchanged %d",
+		strings.Join(c.Started, ", "),
+		strings.Join(c.Stopped, ", "),
+		strings.Join(c.Restarted, ", "),
+		len(c.Unchanged),
+	)
+}
+
+// NewAgent starts every tunnel of the config. The token and topology of the
+// initial config are used for reloaded configs which leave them empty.
+func NewAgent(ctx context.Context, cfg *AgentConfig, options ...ClientOption) (*Agent, error) {
+	a := Agent{
+		ctx:     ctx,
+		options: options,
+		defaults: AgentConfig{
+			Token:    cfg.Token,
+			Topology: cfg.Topology,
+		},
+		tunnels: make(map[string]*runningTunnel),
+	}
+
+	if _, err := a.Apply(cfg); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// InitServices runs every tunnel of the config in one process. The topology
+// is fetched once and the grpc connection to the gate is shared between the
+// tunnels.
+func InitServices(ctx context.Context, cfg *AgentConfig, options ...ClientOption) error {
+	agent, err := NewAgent(ctx, cfg, options...)
+	if err != nil {
+		return err
+	}
+
+	agent.Wait()
+
+	return ctx.Err()
+}
+
+// Apply diffs the config against the running tunnels, starts the new ones,
+// stops the removed ones and restarts the changed ones. An invalid config is
+// rejected and the running tunnels are left as they are.
+func (a *Agent) Apply(cfg *AgentConfig) (ConfigChanges, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var changes ConfigChanges
+
+	cfg = a.withDefaults(cfg)
+
+	if err := cfg.Validate(); err != nil {
+		return changes, err
+	}
+
+	session := a.session
+	if session == nil || a.config.Topology != cfg.Topology {
+		var err error
+
+		session, err = NewSession(a.ctx, cfg.Topology)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	desired := make(map[string]TunnelConfig)
+	for _, tunnel := range cfg.Tunnels {
+		if tunnel.Token == "" {
+			tunnel.Token = cfg.Token
+		}
+
+		desired[tunnel.Name] = tunnel
+	}
+
+	for name, running := range a.tunnels {
+		tunnel, ok := desired[name]
+		if ok && reflect.DeepEqual(tunnel, running.config) && session == a.session {
+			changes.Unchanged = append(changes.Unchanged, name)
+			continue
+		}
+
+		running.cancel()
+		<-running.done
+		delete(a.tunnels, name)
+
+		if ok {
+			changes.Restarted = append(changes.Restarted, name)
+		} else {
+			changes.Stopped = append(changes.Stopped, name)
+		}
+	}
+
+	if a.session != nil && session != a.session {
+		a.session.Close()
+	}
+
+	a.session = session
+	a.config = cfg
+
+	for name, tunnel := range desired {
+		if _, ok := a.tunnels[name]; ok {
+			continue
+		}
+
+		a.start(tunnel)
+
+		if !contains(changes.Restarted, name) {
+			changes.Started = append(changes.Started, name)
+		}
+	}
+
+	sort.Strings(changes.Started)
+	sort.Strings(changes.Stopped)
+	sort.Strings(changes.Restarted)
+	sort.Strings(changes.Unchanged)
+
+	return changes, nil
+}
+
+func (a *Agent) withDefaults(cfg *AgentConfig) *AgentConfig {
+	merged := *cfg
+
+	if merged.Token == "" {
+		merged.Token = a.defaults.Token
+	}
+
+	if merged.Topology == "" {
+		merged.Topology = a.defaults.Topology
+	}
+
+	return &merged
+}
+
+func (a *Agent) start(tunnel TunnelConfig) {
+	ctx, cancel := context.WithCancel(a.ctx)
+
+	running := &runningTunnel{
+		config: tunnel,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	a.tunnels[tunnel.Name] = running
+
+	options := append([]ClientOption{WithSession(a.session)}, a.options...)
+	options = append(options, tunnel.Options()...)
+
+	a.wg.Add(1)
+
+	go func() {
+		defer a.wg.Done()
+
+		a.run(ctx, tunnel, options)
+
+		cancel()
+		close(running.done)
+
+		a.mu.Lock()
+		if a.tunnels[tunnel.Name] == running {
+			delete(a.tunnels, tunnel.Name)
+		}
+		a.mu.Unlock()
+	}()
+}
+
+// run runs the tunnel until the context is done, restarting it with a
+// backoff when it stops with an error.
+func (a *Agent) run(ctx context.Context, tunnel TunnelConfig, options []ClientOption) {
+	delay := tunnelRestartDelay
+
+	for {
+		startedAt := time.Now()
+
+		err := InitServiceTarget(ctx, tunnel.Name, tunnel.Token, tunnel.TargetURL(), options)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(startedAt) > maxTunnelRestartDelay {
+			delay = tunnelRestartDelay
+		}
+
+		log.Printf("tunnel %s stopped: %v, restart in %s\r\n", tunnel.Name, err, delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxTunnelRestartDelay {
+			delay = maxTunnelRestartDelay
+		}
+	}
+}
+
+// Reload reads the config file again and applies it, with the token and the
+// topology the agent started with when the file has none.
+func (a *Agent) Reload(path string) error {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	changes, err := a.Apply(cfg)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("config reloaded: %s\r\n", changes)
+
+	return nil
+}
+
+// WatchConfig polls the config file and reloads it when it changes or when a
+// signal arrives on the reload channel. Invalid configs are logged and
+// skipped.
+func (a *Agent) WatchConfig(path string, interval time.Duration, reload <-chan os.Signal) {
+	var lastMod time.Time
+	var lastSize int64
+
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+		lastSize = info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+
+			lastMod = info.ModTime()
+			lastSize = info.Size()
+		}
+
+		if err := a.Reload(path); err != nil {
+			log.Printf("reject config %s: %s\r\n", path, err)
+		}
+	}
+}
+
+// Wait blocks until the agent context is done and every tunnel has stopped.
+func (a *Agent) Wait() {
+	<-a.ctx.Done()
+	a.wg.Wait()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
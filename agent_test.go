@@ -0,0 +1,241 @@
+package pinge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestLoadConfigWithoutToken(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	path := filepath.Join(t.TempDir(), "pinge.json")
+
+	b, _ := json.Marshal(AgentConfig{
+		Topology: topology.URL(),
+		Tunnels:  []TunnelConfig{{Name: "web", Target: newEchoServer(t)}},
+	})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("config without any token is valid")
+	}
+
+	// the token comes from the flags or the environment
+	cfg.Token = "token"
+
+	if _, err := NewAgent(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	ctx, cancel := context.WithCancel(testContext(t))
+	defer cancel()
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	registry := NewRegistry()
+
+	admin := httptest.NewServer(NewAdminHandler(registry, nil))
+	t.Cleanup(admin.Close)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	cfg := &AgentConfig{
+		Token:    "token",
+		Topology: topology.URL(),
+		Tunnels: []TunnelConfig{
+			{Name: "web", Host: "127.0.0.1", Port: port},
+			{Name: "api", Target: newEchoServer(t), Private: true},
+		},
+	}
+
+	agent, err := NewAgent(ctx, cfg, WithRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"web", "api"} {
+		if err := gate.WaitConnected(ctx, name, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := topology.Requests(); n != 1 {
+		t.Fatalf("topology fetched %d times, want once for every tunnel", n)
+	}
+
+	var statuses []ClientStatus
+	waitFor(t, func() bool {
+		getJSON(t, admin.URL+"/status", &statuses)
+		return len(statuses) == 2
+	}, "status of both tunnels")
+
+	if statuses[0].Service != "api" || statuses[1].Service != "web" {
+		t.Fatalf("unexpected statuses %+v", statuses)
+	}
+
+	for _, req := range gate.ConnectRequests() {
+		if req.Private != (req.ServiceName == "api") || req.Token != "token" {
+			t.Fatalf("unexpected connect request %+v", req)
+		}
+	}
+
+	// a tunnel with its own token overrides the agent token
+	changes, err := agent.Apply(&AgentConfig{
+		Tunnels: []TunnelConfig{
+			{Name: "web", Host: "127.0.0.1", Port: port},
+			{Name: "db", Host: "127.0.0.1", Port: port, Token: "db-token"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ConfigChanges{Started: []string{"db"}, Stopped: []string{"api"}, Unchanged: []string{"web"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got changes %s, want %s", changes, want)
+	}
+
+	if err := gate.WaitConnected(ctx, "api", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gate.WaitConnected(ctx, "db", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range gate.ConnectRequests() {
+		if req.ServiceName == "db" && req.Token != "db-token" {
+			t.Fatalf("db connected with token %q", req.Token)
+		}
+	}
+
+	if n := countConnects(gate, "web"); n != 1 {
+		t.Fatalf("unchanged tunnel connected %d times", n)
+	}
+
+	if _, err := agent.Apply(&AgentConfig{Tunnels: []TunnelConfig{{Name: "bad name", Port: port}}}); err == nil {
+		t.Fatal("invalid config is applied")
+	}
+
+	cancel()
+	agent.Wait()
+}
+
+func TestAgentRestartsFailedTunnel(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	gate.FailNext(pingetest.ErrInvalidToken)
+
+	_, err := NewAgent(ctx, &AgentConfig{
+		Token:    "token",
+		Topology: topology.URL(),
+		Tunnels:  []TunnelConfig{{Name: "web", Target: newEchoServer(t)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countConnects(gate, "web"); n != 2 {
+		t.Fatalf("web connected %d times, want a rejected connect and a restart", n)
+	}
+}
+
+func TestAgentWatchConfig(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	backend := newEchoServer(t)
+
+	path := filepath.Join(t.TempDir(), "pinge.json")
+
+	writeConfig := func(names ...string) {
+		// the token is given to the agent only, like with -token
+		cfg := AgentConfig{Topology: topology.URL()}
+		for _, name := range names {
+			cfg.Tunnels = append(cfg.Tunnels, TunnelConfig{Name: name, Target: backend})
+		}
+
+		b, _ := json.Marshal(cfg)
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("web")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Token = "token"
+
+	agent, err := NewAgent(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload := make(chan os.Signal)
+	go agent.WatchConfig(path, 10*time.Millisecond, reload)
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file changes
+	writeConfig("web", "api")
+
+	if err := gate.WaitConnected(ctx, "api", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid config keeps the running tunnels
+	os.WriteFile(path, []byte(`{"tunnels": []}`), 0600)
+	time.Sleep(100 * time.Millisecond)
+
+	if !gate.Connected("web") || !gate.Connected("api") {
+		t.Fatal("invalid config stopped the tunnels")
+	}
+
+	// SIGHUP reloads the file as well
+	writeConfig("api")
+	reload <- syscall.SIGHUP
+
+	if err := gate.WaitConnected(ctx, "web", false); err != nil {
+		t.Fatal(err)
+	}
+}
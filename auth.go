@@ -0,0 +1,140 @@
+package pinge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const rejectUnauthorized = "unauthorized"
+
+// AuthOptions restrict who may reach the local backend of a tunnel, they
+// need http mode. When several kinds of credentials are configured, any one
+// of them is enough.
+type AuthOptions struct {
+	// BasicUsers maps user names to bcrypt hashes of their passwords.
+	BasicUsers      map[string]string `json:"basic_users,omitempty"`
+	BearerTokens    []string          `json:"bearer_tokens,omitempty"`
+	SignedURLSecret string            `json:"signed_url_secret,omitempty"`
+}
+
+func WithAuth(options AuthOptions) ClientOption {
+	return func(c *Client) {
+		c.authOptions = &options
+	}
+}
+
+type authenticator struct {
+	options AuthOptions
+}
+
+func newAuthenticator(options AuthOptions) *authenticator {
+	return &authenticator{options: options}
+}
+
+func (a *authenticator) hasCredentials() bool {
+	return len(a.options.BasicUsers) > 0 || len(a.options.BearerTokens) > 0 || a.options.SignedURLSecret != ""
+}
+
+func (a *authenticator) allowRequest(r *http.Request) bool {
+	if !a.hasCredentials() {
+		return true
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, ok := a.options.BasicUsers[user]; ok {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+				return true
+			}
+		}
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+		for _, allowed := range a.options.BearerTokens {
+			if subtle.ConstantTimeCompare(token, []byte(allowed)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if a.options.SignedURLSecret != "" && verifySignedURL(a.options.SignedURLSecret, r.URL) {
+		return true
+	}
+
+	return false
+}
+
+// middleware answers 401 to requests without valid credentials.
+func (a *authenticator) middleware(client *Client, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowRequest(r) {
+			client.recordRejection(rejectUnauthorized)
+
+			if len(a.options.BasicUsers) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="pinge"`)
+			}
+
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SignURL adds expires and signature query parameters to the url, which are
+// accepted by tunnels with the same SignedURLSecret until the expiry time.
+func SignURL(secret string, rawURL string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Del("signature")
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+
+	u.RawQuery = query.Encode()
+
+	query.Set("signature", urlSignature(secret, u.Path, u.RawQuery))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func verifySignedURL(secret string, u *url.URL) bool {
+	query := u.Query()
+
+	signature := query.Get("signature")
+	if signature == "" {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	query.Del("signature")
+
+	expected := urlSignature(secret, u.Path, query.Encode())
+
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+func urlSignature(secret string, path string, rawQuery string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "?" + rawQuery))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,120 @@
+package pinge
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	registry := NewRegistry()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newHeaderServer(t)
+
+	go InitServiceTarget(ctx, "web", "token", backend.Listener.Addr().String(), []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithRegistry(registry),
+		WithHTTP(HTTPOptions{}),
+		WithAuth(AuthOptions{
+			BasicUsers:      map[string]string{"alice": string(hash)},
+			BearerTokens:    []string{"token-1", "token-2"},
+			SignedURLSecret: "secret",
+		}),
+	})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	base := "http://" + gate.URI("web")
+
+	signed, err := SignURL("secret", base+"/file?name=a", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, _ := SignURL("secret", base+"/file?name=a", time.Now().Add(-time.Second))
+	otherSecret, _ := SignURL("other", base+"/file?name=a", time.Now().Add(time.Hour))
+
+	tampered, _ := url.Parse(signed)
+	query := tampered.Query()
+	query.Set("name", "b")
+	tampered.RawQuery = query.Encode()
+
+	tests := []struct {
+		name   string
+		url    string
+		header func(r *http.Request)
+		status int
+	}{
+		{name: "no credentials", url: base + "/", status: http.StatusUnauthorized},
+		{name: "basic", url: base + "/", header: func(r *http.Request) { r.SetBasicAuth("alice", "password") }, status: http.StatusOK},
+		{name: "wrong password", url: base + "/", header: func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, status: http.StatusUnauthorized},
+		{name: "unknown user", url: base + "/", header: func(r *http.Request) { r.SetBasicAuth("bob", "password") }, status: http.StatusUnauthorized},
+		{name: "bearer", url: base + "/", header: func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-2") }, status: http.StatusOK},
+		{name: "wrong bearer", url: base + "/", header: func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-3") }, status: http.StatusUnauthorized},
+		{name: "signed url", url: signed, status: http.StatusOK},
+		{name: "expired url", url: expired, status: http.StatusUnauthorized},
+		{name: "other secret", url: otherSecret, status: http.StatusUnauthorized},
+		{name: "tampered url", url: tampered.String(), status: http.StatusUnauthorized},
+	}
+
+	var rejected int64
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		if test.header != nil {
+			test.header(req)
+		}
+
+		res, err := gate.HTTPClient("web").Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: got %s, want %d", test.name, res.Status, test.status)
+		}
+
+		if res.StatusCode == http.StatusUnauthorized {
+			rejected++
+
+			if res.Header.Get("WWW-Authenticate") != `Basic realm="pinge"` {
+				t.Errorf("%s: 401 without basic auth challenge", test.name)
+			}
+		}
+	}
+
+	if got := registry.Clients()[0].Status().Rejected[rejectUnauthorized]; got != rejected {
+		t.Fatalf("got %d rejections, want %d", got, rejected)
+	}
+}
+
+func TestAuthRequiresHTTP(t *testing.T) {
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	err := InitServiceTarget(testContext(t), "web", "token", newEchoServer(t), []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithAuth(AuthOptions{BearerTokens: []string{"token"}}),
+	})
+	if err == nil {
+		t.Fatal("credentials are accepted in tcp mode")
+	}
+}
@@ -0,0 +1,316 @@
+package pinge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategyRandom           = "random"
+)
+
+var ErrorNoHealthyBackends = errors.New("no healthy backends")
+
+// BalancerOptions spread the connections of one tunnel between several local
+// backends.
+type BalancerOptions struct {
+	Backends    []string            `json:"backends"`
+	Strategy    string              `json:"strategy,omitempty"`
+	HealthCheck *HealthCheckOptions `json:"health_check,omitempty"`
+}
+
+// HealthCheckOptions enable active checks of the backends. Without Path a
+// backend is healthy when it accepts tcp connections, with Path when GET of
+// the path answers 2xx or 3xx.
+type HealthCheckOptions struct {
+	Path               string   `json:"path,omitempty"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+}
+
+func WithBalancer(options BalancerOptions) ClientOption {
+	return func(c *Client) {
+		c.balancerOptions = &options
+	}
+}
+
+type BackendStatus struct {
+	Address     string `json:"address"`
+	Healthy     bool   `json:"healthy"`
+	Connections int64  `json:"connections"`
+}
+
+type backend struct {
+	connections int64
+
+	address string
+	target  *Target
+
+	mu        sync.Mutex
+	healthy   bool
+	successes int
+	failures  int
+}
+
+func (b *backend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.healthy
+}
+
+func (b *backend) report(ok bool, options *HealthCheckOptions) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		b.failures = 0
+		b.successes++
+
+		if !b.healthy && b.successes >= options.HealthyThreshold {
+			fmt.Println("backend is healthy", b.address)
+			b.healthy = true
+		}
+
+		return
+	}
+
+	b.successes = 0
+	b.failures++
+
+	if b.healthy && b.failures >= options.UnhealthyThreshold {
+		fmt.Println("backend is unhealthy", b.address)
+		b.healthy = false
+	}
+}
+
+type balancer struct {
+	options  BalancerOptions
+	backends []*backend
+	next     uint64
+}
+
+func newBalancer(options BalancerOptions) (*balancer, error) {
+	if len(options.Backends) == 0 {
+		return nil, fmt.Errorf("balancer has no backends")
+	}
+
+	switch options.Strategy {
+	case "":
+		options.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastConnections, StrategyRandom:
+	default:
+		return nil, fmt.Errorf("unknown balancer strategy %q", options.Strategy)
+	}
+
+	if options.HealthCheck != nil {
+		check := *options.HealthCheck
+		options.HealthCheck = &check
+
+		if check.Interval <= 0 {
+			check.Interval = Duration(10 * time.Second)
+		}
+
+		if check.Timeout <= 0 {
+			check.Timeout = Duration(2 * time.Second)
+		}
+
+		if check.HealthyThreshold <= 0 {
+			check.HealthyThreshold = 2
+		}
+
+		if check.UnhealthyThreshold <= 0 {
+			check.UnhealthyThreshold = 3
+		}
+	}
+
+	b := balancer{
+		options: options,
+	}
+
+	for _, address := range options.Backends {
+		target, err := ParseTarget(address)
+		if err != nil {
+			return nil, err
+		}
+
+		b.backends = append(b.backends, &backend{
+			address: address,
+			target:  target,
+			healthy: true,
+		})
+	}
+
+	return &b, nil
+}
+
+// order returns the backends in the order they should be tried, the first
+// one picked by the strategy. Unhealthy backends are left out.
+func (b *balancer) order() []*backend {
+	var healthy []*backend
+
+	for _, backend := range b.backends {
+		if backend.isHealthy() {
+			healthy = append(healthy, backend)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	var first int
+
+	switch b.options.Strategy {
+	case StrategyRoundRobin:
+		first = int(atomic.AddUint64(&b.next, 1)-1) % len(healthy)
+	case StrategyRandom:
+		first = rand.Intn(len(healthy))
+	case StrategyLeastConnections:
+		for i, backend := range healthy {
+			if atomic.LoadInt64(&backend.connections) < atomic.LoadInt64(&healthy[first].connections) {
+				first = i
+			}
+		}
+	}
+
+	return append(healthy[first:], healthy[:first]...)
+}
+
+// dial connects to the backend picked by the strategy, and falls through to
+// the next ones when it refuses the connection.
+func (b *balancer) dial(ctx context.Context) (net.Conn, error) {
+	backends := b.order()
+	if len(backends) == 0 {
+		return nil, ErrorNoHealthyBackends
+	}
+
+	var lastErr error
+
+	for _, backend := range backends {
+		conn, err := backend.target.Dial(ctx)
+		if err != nil {
+			fmt.Println("cannot dial backend", backend.address, err)
+			lastErr = err
+			continue
+		}
+
+		atomic.AddInt64(&backend.connections, 1)
+
+		return &backendConn{Conn: conn, backend: backend}, nil
+	}
+
+	return nil, lastErr
+}
+
+func (b *balancer) status() []BackendStatus {
+	var statuses []BackendStatus
+
+	for _, backend := range b.backends {
+		statuses = append(statuses, BackendStatus{
+			Address:     backend.address,
+			Healthy:     backend.isHealthy(),
+			Connections: atomic.LoadInt64(&backend.connections),
+		})
+	}
+
+	return statuses
+}
+
+func (b *balancer) runHealthChecks(ctx context.Context) {
+	check := b.options.HealthCheck
+	if check == nil {
+		return
+	}
+
+	for _, item := range b.backends {
+		go func(backend *backend) {
+			ticker := time.NewTicker(time.Duration(check.Interval))
+			defer ticker.Stop()
+
+			for {
+				backend.report(b.check(ctx, backend), check)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(item)
+	}
+}
+
+func (b *balancer) check(ctx context.Context, backend *backend) bool {
+	check := b.options.HealthCheck
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.Timeout))
+	defer cancel()
+
+	if check.Path == "" {
+		conn, err := backend.target.Dial(ctx)
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+
+		return true
+	}
+
+	httpc := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return backend.target.Dial(ctx)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+backend.target.Host()+check.Path, nil)
+	if err != nil {
+		return false
+	}
+
+	res, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+
+	res.Body.Close()
+
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+type backendConn struct {
+	net.Conn
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *backendConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+func (c *backendConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.backend.connections, -1)
+	})
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,145 @@
+package pinge
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+// newNamedServer starts an http backend answering with its name, /health
+// answers 200 while healthy is not zero.
+func newNamedServer(t *testing.T, name string, healthy *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestBalancerHTTP(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	healthyA, healthyB := int32(1), int32(1)
+	a := newNamedServer(t, "a", &healthyA)
+	b := newNamedServer(t, "b", &healthyB)
+
+	registry := NewRegistry()
+
+	// the target is not needed with a balancer
+	go InitServiceTarget(ctx, "web", "token", "", []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithRegistry(registry),
+		WithHTTP(HTTPOptions{}),
+		WithBalancer(BalancerOptions{
+			Backends: []string{a.Listener.Addr().String(), b.Listener.Addr().String()},
+			HealthCheck: &HealthCheckOptions{
+				Path:               "/health",
+				Interval:           Duration(20 * time.Millisecond),
+				HealthyThreshold:   1,
+				UnhealthyThreshold: 1,
+			},
+		}),
+	})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// one visitor connection keeps alive across the requests, the backends
+	// still take turns
+	httpc := &http.Client{Transport: &http.Transport{DialContext: gate.HTTPClient("web").Transport.(*http.Transport).DialContext}}
+
+	get := func() string {
+		res, err := httpc.Get("http://" + gate.URI("web") + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer res.Body.Close()
+
+		b, _ := io.ReadAll(res.Body)
+
+		return string(b)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		counts[get()]++
+	}
+
+	if counts["a"] != 3 || counts["b"] != 3 {
+		t.Fatalf("got %v, want round robin between a and b", counts)
+	}
+
+	atomic.StoreInt32(&healthyB, 0)
+
+	waitFor(t, func() bool {
+		backends := registry.Clients()[0].Status().Backends
+		return len(backends) == 2 && backends[0].Healthy && !backends[1].Healthy
+	}, "b to be unhealthy")
+
+	for i := 0; i < 4; i++ {
+		if got := get(); got != "a" {
+			t.Fatalf("unhealthy backend %s got a request", got)
+		}
+	}
+
+	atomic.StoreInt32(&healthyB, 1)
+
+	waitFor(t, func() bool {
+		return registry.Clients()[0].Status().Backends[1].Healthy
+	}, "b to be healthy again")
+
+	counts = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		counts[get()]++
+	}
+
+	if counts["b"] == 0 {
+		t.Fatalf("got %v, want b back in the rotation", counts)
+	}
+}
+
+func TestBalancerDialFallsThrough(t *testing.T) {
+	healthy := int32(1)
+	server := newNamedServer(t, "a", &healthy)
+
+	// nothing listens on port 1
+	balancer, err := newBalancer(BalancerOptions{
+		Backends: []string{"127.0.0.1:1", server.Listener.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := balancer.dial(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if balancer.status()[1].Connections != 1 {
+			t.Fatalf("connections of the live backend: %+v", balancer.status())
+		}
+
+		conn.Close()
+	}
+
+	if _, err := newBalancer(BalancerOptions{Backends: []string{"a:1"}, Strategy: "sticky"}); err == nil {
+		t.Fatal("unknown strategy is accepted")
+	}
+}
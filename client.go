@@ -5,15 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net"
-	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pinge-link/sdk/spec"
 
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -21,6 +20,8 @@ var (
 	ErrorAllGatesBusy = errors.New("all gates busy")
 )
 
+const readinessTimeout = 30 * time.Second
+
 type connectOptions struct {
 	Kind    int    `json:"kind"`
 	Token   string `json:"token"`
@@ -38,8 +39,30 @@ type Client struct {
 	customDomain    string
 	topologyAddress string
 	region          *TopologyRegion
+	session         *Session
+	registry        *Registry
+	httpOptions     *HTTPOptions
+	inspector       *Inspector
+	authOptions     *AuthOptions
+	auth            *authenticator
+	balancerOptions *BalancerOptions
+	balancer        *balancer
+	idleTimeout     time.Duration
+	maxLifetime     time.Duration
+	limits          *limiter
+	uriHandler      func(uri string)
+	readiness       func(ctx context.Context) error
 	ctx             context.Context
-	uri             string
+	cancel          context.CancelFunc
+
+	mu             sync.RWMutex
+	uri            string
+	uriReady       chan struct{}
+	connectedSince time.Time
+	reconnects     int
+	conns          map[*trackedConn]struct{}
+	rejected       map[string]int64
+	err            error
 }
 
 type ClientOption func(*Client)
@@ -74,106 +97,128 @@ func WithCustomDomain(domain string) ClientOption {
 	}
 }
 
-func InitClient(ctx context.Context, serviceName string, token string, options ...ClientOption) (*Client, error) {
-	topologyDefault := "http://topology.pinge.dev:5004"
-
-	c := Client{
-		accepter:        make(chan net.Conn),
-		token:           token,
-		serviceName:     serviceName,
-		topologyAddress: topologyDefault,
-		ctx:             ctx,
+func WithSession(session *Session) ClientOption {
+	return func(c *Client) {
+		c.session = session
 	}
+}
 
-	for _, option := range options {
-		option(&c)
+func WithHTTP(options HTTPOptions) ClientOption {
+	return func(c *Client) {
+		c.httpOptions = &options
 	}
+}
 
-	topology, err := c.getTopology()
-	if err != nil {
-		return nil, fmt.Errorf("cannot get topology: %w", err)
+// WithIdleTimeout closes proxied connections without traffic in both
+// directions for the duration.
+func WithIdleTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.idleTimeout = timeout
 	}
+}
 
-	region, err := c.selectRegion(topology)
-	if err != nil {
-		return nil, err
+// WithMaxLifetime closes proxied connections after the duration, tcp mode
+// only.
+func WithMaxLifetime(lifetime time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxLifetime = lifetime
 	}
+}
 
-	c.region = region
-
-	c.gateHost = region.Gates[0].SecondaryAddress
-	c.initHost = region.Gates[0].PrimaryAddress
-
-	c.initPrimary()
-
-	return &c, nil
+// WithURIHandler calls the handler with the public uri of the service each
+// time the gate sends it.
+func WithURIHandler(handler func(uri string)) ClientOption {
+	return func(c *Client) {
+		c.uriHandler = handler
+	}
 }
 
-func (c *Client) getTopology() (*TopologyConfig, error) {
-	res, err := http.Get(c.topologyAddress)
-	if err != nil {
-		return nil, err
+// WithReadiness holds new visitors until the wait returns, for at most
+// readinessTimeout, e.g. while the backend restarts. Visitors are closed
+// when it fails.
+func WithReadiness(wait func(ctx context.Context) error) ClientOption {
+	return func(c *Client) {
+		c.readiness = wait
 	}
+}
 
-	defer res.Body.Close()
+func WithRegistry(registry *Registry) ClientOption {
+	return func(c *Client) {
+		c.registry = registry
+	}
+}
 
-	var cfg TopologyConfig
+func InitClient(ctx context.Context, serviceName string, token string, options ...ClientOption) (*Client, error) {
+	ctx, cancel := context.WithCancel(ctx)
 
-	if err := json.NewDecoder(res.Body).Decode(&cfg); err != nil {
-		return nil, err
+	c := Client{
+		accepter:        make(chan net.Conn),
+		token:           token,
+		serviceName:     serviceName,
+		topologyAddress: topologyDefault,
+		ctx:             ctx,
+		cancel:          cancel,
+		conns:           make(map[*trackedConn]struct{}),
+		rejected:        make(map[string]int64),
+		uriReady:        make(chan struct{}),
 	}
 
-	return &cfg, nil
-}
+	for _, option := range options {
+		option(&c)
+	}
 
-func (c *Client) selectRegion(topology *TopologyConfig) (*TopologyRegion, error) {
-	var bestRegion *TopologyRegion
-	var bestPingTime time.Duration
+	if c.authOptions != nil {
+		c.auth = newAuthenticator(*c.authOptions)
+	}
 
-	for i, region := range topology.Regions {
-		opts := []grpc.DialOption{
-			grpc.WithInsecure(),
+	if c.balancerOptions != nil {
+		balancer, err := newBalancer(*c.balancerOptions)
+		if err != nil {
+			cancel()
+			return nil, err
 		}
 
-		conn, err := grpc.Dial(region.PingHost, opts...)
+		c.balancer = balancer
+	}
+
+	if c.session == nil {
+		session, err := NewSession(ctx, c.topologyAddress)
 		if err != nil {
-			fmt.Printf("host %s for region %s, not available: %s\r\n", region.Id, region.PingHost, err)
-			continue
+			cancel()
+			return nil, err
 		}
 
-		pingerClient := spec.NewServiceClient(conn)
+		c.session = session
+	}
 
-		startTime := time.Now()
+	region := *c.session.region
+	region.Gates = append([]TopologyGate{}, region.Gates...)
 
-		if _, err := pingerClient.Ping(context.Background(), &spec.PingRequestResponse{}); err != nil {
-			fmt.Printf("host %s for region %s, not available: %s\r\n", region.Id, region.PingHost, err)
-			continue
-		}
+	c.region = &region
 
-		execTime := time.Since(startTime)
+	c.gateHost = region.Gates[0].SecondaryAddress
+	c.initHost = region.Gates[0].PrimaryAddress
 
-		if bestRegion == nil {
-			bestRegion = &topology.Regions[i]
-			bestPingTime = execTime
-		} else if execTime < bestPingTime {
-			bestRegion = &topology.Regions[i]
-			bestPingTime = execTime
-		}
-	}
+	c.initPrimary()
 
-	if bestRegion == nil {
-		return nil, fmt.Errorf("cannot find available gates")
+	if c.registry != nil {
+		c.registry.add(&c)
+
+		go func() {
+			<-ctx.Done()
+			c.registry.remove(&c)
+		}()
 	}
 
-	return bestRegion, nil
+	return &c, nil
 }
 
 func (c *Client) initPrimary() error {
-	opts := []grpc.DialOption{
-		grpc.WithInsecure(),
-	}
+	c.mu.RLock()
+	initHost := c.initHost
+	c.mu.RUnlock()
 
-	conn, err := grpc.Dial(c.initHost, opts...)
+	conn, err := c.session.dial(initHost)
 	if err != nil {
 		return err
 	}
@@ -190,62 +235,54 @@ func (c *Client) initPrimary() error {
 		return err
 	}
 
+	c.mu.Lock()
+	c.connectedSince = time.Now()
+	c.mu.Unlock()
+
 	go func() {
 		for {
 			resp, err := stream.Recv()
 			if err != nil {
-				respStatus, ok := status.FromError(err)
-				if ok {
-					log.Fatal(respStatus.Message())
-				}
-
-				/*if strings.Contains(err.Error(), "cannot get token") {
-					log.Fatalf("token %s is invalid \r\n", c.token)
-				} else if strings.Contains(err.Error(), "must contain English letters and digits only") {
-					log.Fatal(err)
-				} else {
-					fmt.Println(err)
-				}*/
-
 				select {
 				case <-c.ctx.Done():
 					return
 				default:
 				}
 
-				if strings.Contains(err.Error(), "service exist") { // use grpc error
+				if isServiceExist(err) {
 					if err := c.busyGate(); err != nil {
-						log.Fatal(err)
+						c.fail(err)
 						return
 					}
+				} else if isPermanent(err) {
+					c.fail(fmt.Errorf("gate rejected service %s: %w", c.serviceName, err))
+					return
 				}
-			reconnectLoop:
-				for {
-					select {
-					case <-time.After(time.Second):
-						fmt.Println("reconnect")
-						if err := c.initPrimary(); err == nil {
-							fmt.Println("reconnect error", err)
-							break reconnectLoop
-						}
-					}
-				}
+
+				fmt.Println("gate connection lost", err)
+				c.reconnect()
+
 				return
 			}
 
 			switch resp.Kind {
 			case spec.Type_OPEN:
-				secondConn, err := c.getConnection(c.serviceName, c.token)
-				if err != nil {
-					fmt.Println("cannot get connection")
-					return
-				}
-
-				c.accepter <- secondConn
+				go c.open()
 			case spec.Type_SET_INFO:
+				c.mu.Lock()
 				c.uri = resp.ProjectUri
+				select {
+				case <-c.uriReady:
+				default:
+					close(c.uriReady)
+				}
+				c.mu.Unlock()
 
 				fmt.Printf("Service URL: https://%s\r\n", resp.ProjectUri)
+
+				if c.uriHandler != nil {
+					c.uriHandler(resp.ProjectUri)
+				}
 			}
 		}
 	}()
@@ -253,7 +290,99 @@ func (c *Client) initPrimary() error {
 	return nil
 }
 
+// reconnect connects to the gate again every second until it succeeds or
+// the client is closed.
+func (c *Client) reconnect() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		fmt.Println("reconnect")
+
+		c.mu.Lock()
+		c.reconnects++
+		c.mu.Unlock()
+
+		err := c.initPrimary()
+		if err == nil {
+			return
+		}
+
+		fmt.Println("reconnect error", err)
+	}
+}
+
+// fail closes the client with an error the gate will not recover from, it
+// is returned by Accept.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+
+	fmt.Println(err)
+	c.cancel()
+}
+
+func (c *Client) failure() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.err
+}
+
+func isServiceExist(err error) bool {
+	respStatus, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	return respStatus.Code() == codes.AlreadyExists || strings.Contains(respStatus.Message(), "service exist")
+}
+
+// isPermanent reports whether the gate rejected the service itself, e.g. an
+// invalid token or service name, so reconnecting is pointless.
+func isPermanent(err error) bool {
+	respStatus, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	switch respStatus.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied, codes.InvalidArgument:
+		return true
+	}
+
+	return strings.Contains(respStatus.Message(), "cannot get token") ||
+		strings.Contains(respStatus.Message(), "must contain English letters and digits only")
+}
+
+// WaitURI waits until the gate sends the public uri of the service.
+func (c *Client) WaitURI(ctx context.Context) (string, error) {
+	select {
+	case <-c.uriReady:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.ctx.Done():
+		if err := c.failure(); err != nil {
+			return "", err
+		}
+
+		return "", c.ctx.Err()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.uri, nil
+}
+
 func (c *Client) busyGate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	var newGate *TopologyGate
 	for i, gate := range c.region.Gates {
 		if gate.PrimaryAddress == c.initHost {
@@ -276,23 +405,80 @@ func (c *Client) busyGate() error {
 func (c *Client) Accept() (net.Conn, error) {
 	select {
 	case <-c.ctx.Done():
+		if err := c.failure(); err != nil {
+			return nil, err
+		}
+
 		return nil, fmt.Errorf("context deadline")
-	default:
+	case conn := <-c.accepter:
+		return c.trackConn(conn), nil
 	}
-
-	return <-c.accepter, nil
 }
 
 func (c *Client) Close() error {
+	c.cancel()
 	return nil
 }
 
 func (c *Client) Addr() net.Addr {
-	return nil
+	return tunnelAddr(c.serviceName)
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "pinge"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// open connects to the gate for a new visitor and hands the connection to
+// Accept once the tunnel limits admit it.
+func (c *Client) open() {
+	conn, err := c.getConnection(c.serviceName, c.token)
+	if err != nil {
+		fmt.Println("cannot get connection", err)
+		return
+	}
+
+	if c.readiness != nil {
+		ctx, cancel := context.WithTimeout(c.ctx, readinessTimeout)
+		err := c.readiness(ctx)
+		cancel()
+
+		if err != nil {
+			fmt.Println("backend is not ready", err)
+			conn.Close()
+			return
+		}
+	}
+
+	if c.limits != nil {
+		admitted, reason := c.limits.admit(c.ctx, conn)
+		if reason != "" {
+			c.recordRejection(reason)
+			conn.Close()
+			return
+		}
+
+		conn = admitted
+	}
+
+	select {
+	case c.accepter <- conn:
+	case <-c.ctx.Done():
+		conn.Close()
+	}
 }
 
 func (c *Client) getConnection(serviceName string, token string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", c.gateHost)
+	c.mu.RLock()
+	gateHost := c.gateHost
+	c.mu.RUnlock()
+
+	conn, err := net.Dial("tcp", gateHost)
 	if err != nil {
 		return nil, err
 	}
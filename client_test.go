@@ -0,0 +1,277 @@
+package pinge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func newTestGate(t *testing.T, options ...pingetest.GateOption) *pingetest.Gate {
+	gate, err := pingetest.NewGate(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(gate.Close)
+
+	return gate
+}
+
+func newTestTopology(t *testing.T, regions ...pingetest.Region) *pingetest.Topology {
+	topology := pingetest.NewTopology(regions...)
+	t.Cleanup(topology.Close)
+
+	return topology
+}
+
+// newEchoServer starts a tcp backend writing back everything it reads.
+func newEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				io.Copy(conn, conn)
+
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+func TestSelectRegion(t *testing.T) {
+	ctx := testContext(t)
+
+	slow := newTestGate(t, pingetest.WithPingDelay(100*time.Millisecond))
+	fast := newTestGate(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	down := pingetest.Region{Id: "down", PingHost: l.Addr().String()}
+	l.Close()
+
+	topology := newTestTopology(t,
+		pingetest.NewRegion("slow", slow),
+		down,
+		pingetest.NewRegion("fast", fast),
+	)
+
+	session, err := NewSession(ctx, topology.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Region() != "fast" {
+		t.Fatalf("selected region %s, want fast", session.Region())
+	}
+
+	probes := session.Probes()
+	if len(probes) != 3 {
+		t.Fatalf("got %d probes, want 3", len(probes))
+	}
+
+	for i, id := range []string{"slow", "down", "fast"} {
+		if probes[i].Region != id {
+			t.Fatalf("probe %d is for region %s, want %s", i, probes[i].Region, id)
+		}
+	}
+
+	if probes[1].Error == "" || probes[0].Error != "" || probes[2].Error != "" {
+		t.Fatalf("unexpected probe errors %+v", probes)
+	}
+
+	if probes[0].RTT < probes[2].RTT {
+		t.Fatalf("slow region rtt %s is less than fast region rtt %s", probes[0].RTT, probes[2].RTT)
+	}
+}
+
+func TestSelectRegionNoGates(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	down := pingetest.Region{Id: "down", PingHost: l.Addr().String()}
+	l.Close()
+
+	topology := newTestTopology(t, down)
+
+	if _, err := NewSession(testContext(t), topology.URL()); err == nil {
+		t.Fatal("session without available regions was created")
+	}
+}
+
+func TestBusyGate(t *testing.T) {
+	ctx := testContext(t)
+
+	first := newTestGate(t)
+	second := newTestGate(t)
+	first.FailNext(pingetest.ErrServiceExist)
+
+	topology := newTestTopology(t, pingetest.NewRegion("local", first, second))
+
+	c, err := InitClient(ctx, "app", "token", WithTopologyAddress(topology.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := second.WaitConnected(ctx, "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	uri, err := c.WaitURI(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri != second.URI("app") {
+		t.Fatalf("got uri %s, want %s", uri, second.URI("app"))
+	}
+
+	if gate := c.Status().Gate; gate != second.PrimaryAddress() {
+		t.Fatalf("client is on gate %s, want %s", gate, second.PrimaryAddress())
+	}
+
+	gates := c.Topology().Regions[0].Gates
+	if !gates[0].Busy || gates[1].Busy {
+		t.Fatalf("unexpected busy gates %+v", gates)
+	}
+}
+
+func TestAllGatesBusy(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	gate.FailNext(pingetest.ErrServiceExist)
+
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	c, err := InitClient(ctx, "app", "token", WithTopologyAddress(topology.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Accept(); !errors.Is(err, ErrorAllGatesBusy) {
+		t.Fatalf("got error %v, want %v", err, ErrorAllGatesBusy)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t, pingetest.WithTokens("token"))
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	c, err := InitClient(ctx, "app", "invalid", WithTopologyAddress(topology.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Accept(); err == nil || !strings.Contains(err.Error(), "cannot get token") {
+		t.Fatalf("got error %v, want invalid token", err)
+	}
+
+	if n := len(gate.ConnectRequests()); n != 1 {
+		t.Fatalf("client connected %d times, want 1", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	c, err := InitClient(ctx, "app", "token", WithTopologyAddress(topology.URL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := gate.WaitConnected(ctx, "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !gate.Disconnect("app", nil) {
+		t.Fatal("app is not connected")
+	}
+
+	if err := gate.WaitConnected(ctx, "app", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gate.WaitConnected(ctx, "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if reconnects := c.Status().Reconnects; reconnects != 1 {
+		t.Fatalf("got %d reconnects, want 1", reconnects)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	ctx, cancel := context.WithCancel(testContext(t))
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- InitServiceTarget(ctx, "app", "token", newEchoServer(t), []ClientOption{
+			WithTopologyAddress(topology.URL()),
+		})
+	}()
+
+	if err := gate.WaitConnected(testContext(t), "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("service stopped without error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("service is still running")
+	}
+
+	if err := gate.WaitConnected(testContext(t), "app", false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	client "github.com/pinge-link/sdk"
+)
+
+// diagnose checks the tunnel with an internal diagnostics backend, e.g.
+// pinge-agent diagnose -load -requests 200
+func diagnose(args []string) error {
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+
+	serviceName := flags.String("service-name", fmt.Sprintf("diagnose-%d", time.Now().Unix()), "specity service name for the temporary tunnel")
+	token := flags.String("token", os.Getenv("PINGE_TOKEN"), "specity token for pinge.link")
+	initHost := flags.String("init-host", os.Getenv("PINGE_TOPOLOGY_HOST"), "specify init host")
+	timeout := flags.Duration("timeout", time.Minute, "specify timeout for the whole diagnosis")
+	tcp := flags.Bool("tcp", false, "proxy raw tcp to a local diagnostics backend instead of serving it on the tunnel")
+	load := flags.Bool("load", false, "measure throughput and latency through the public url")
+	requests := flags.Int("requests", 100, "specify number of load requests")
+	concurrency := flags.Int("concurrency", 10, "specify number of concurrent load requests")
+	size := flags.Int("size", 64<<10, "specify response size of load requests in bytes")
+	jsonOutput := flags.Bool("json", false, "print the report as json")
+
+	flags.Parse(args)
+
+	if *token == "" {
+		return fmt.Errorf("token is empty")
+	}
+
+	report, err := client.Diagnose(context.Background(), client.DiagnoseOptions{
+		ServiceName:     *serviceName,
+		Token:           *token,
+		TopologyAddress: *initHost,
+		TCP:             *tcp,
+		Timeout:         *timeout,
+		Load:            *load,
+		Requests:        *requests,
+		Concurrency:     *concurrency,
+		Size:            *size,
+	})
+
+	if report != nil {
+		if *jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(report)
+		} else {
+			report.Print(os.Stdout)
+		}
+	}
+
+	return err
+}
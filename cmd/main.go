@@ -5,43 +5,324 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	client "github.com/pinge-link/sdk"
 )
 
 func main() {
-	port := flag.String("port", "", "specify your application port")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		if err := diagnose(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "serve-dir" {
+		if err := serveDir(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	port := flag.String("port", "", "specify your application port, same as -target localhost:<port>")
+	target := flag.String("target", "", "specify your application address: host:port, unix:///path.sock, tls://host:port?insecure=1&sni=name&ca=ca.pem&cert=cert.pem&key=key.pem or https://host")
 	host := flag.String("gate", "", "specify gate host")
 	initHost := flag.String("init-host", "", "specify init host")
 	serviceName := flag.String("service-name", "", "specity service name")
 	token := flag.String("token", "", "specity token for pinge.link")
-	command := flag.String("command", "", "specify command for run")
+	command := flag.String("command", "", "specify command for run, or pass it after --")
+	restart := flag.String("restart", "", "specify restart policy of the command: no, on-failure or always")
+	maxRestarts := flag.Int("max-restarts", 0, "specify max restarts of the command, 0 is unlimited")
+	restartDelay := flag.Duration("restart-delay", time.Second, "specify delay before the command is restarted")
+	stopTimeout := flag.Duration("stop-timeout", 10*time.Second, "kill the command when it does not exit after a signal for the duration")
+	readyTarget := flag.String("ready-target", "", "expose the tunnel once the address accepts connections, the target by default, of the first tunnel with -config")
+	readyPath := flag.String("ready-path", "", "expose the tunnel once http GET of the path answers 2xx")
 	private := flag.Bool("private", false, "access to service by token")
 	docker := flag.Bool("docker", false, "scan docker containers and pinge labels")
+	dockerStateFile := flag.String("docker-state-file", "", "write the urls of the container tunnels to the json file")
+	discoveryAddr := flag.String("discovery-addr", "", "serve the urls of the container tunnels to containers at the address, e.g. 172.17.0.1:4041")
+	containerRuntime := flag.String("container-runtime", "", "specify container runtime of -docker: docker or podman, detected by default")
+	dockerProject := flag.String("docker-project", "", "expose only the containers of the docker-compose project")
+	dockerNameTemplate := flag.String("docker-name-template", "", "specify service name template of containers, e.g. {{.Project}}-{{.Service}}, with .Project, .Service, .Container and .Name")
+	dockerNetwork := flag.String("docker-network", "", "specify docker network shared by the agent and the containers when the agent runs in a container")
+	dockerHost := flag.String("docker-host", "", "specify docker daemon, unix:///path.sock or tcp://host:port, DOCKER_HOST by default")
+	kubernetes := flag.Bool("kubernetes", false, "expose kubernetes services and pods annotated with pinge.link/service")
+	kubernetesServer := flag.String("kubernetes-server", "", "specify kubernetes api server, the cluster of the pod by default")
+	kubernetesToken := flag.String("kubernetes-token", "", "specify bearer token for the kubernetes api, the service account by default")
+	kubernetesCA := flag.String("kubernetes-ca", "", "specify ca file of the kubernetes api server")
+	kubernetesInsecure := flag.Bool("kubernetes-insecure", false, "skip tls verification of the kubernetes api server")
+	kubernetesNamespace := flag.String("kubernetes-namespace", "", "watch the namespace only, every namespace by default")
 	customDomain := flag.String("custom-domain", "", "specify custom domain for service")
+	adminAddr := flag.String("admin-addr", "", "specify local address for admin api, e.g. 127.0.0.1:4040")
+	configPath := flag.String("config", "", "specify config file with tunnels")
+	httpMode := flag.Bool("http", false, "proxy http requests instead of raw tcp")
+	rewriteHost := flag.Bool("rewrite-host", false, "rewrite Host header to the local address, http mode only")
+	forwardedHeaders := flag.Bool("forwarded-headers", false, "add X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers without the visitor address, http mode only")
+
+	inspect := flag.Bool("inspect", false, "record http traffic and browse it at /inspect/ of the admin api, implies -http")
+	inspectCapacity := flag.Int("inspect-capacity", 100, "specify how many requests the inspector keeps")
+	inspectMaxBody := flag.Int64("inspect-max-body", 64<<10, "specify how many body bytes the inspector keeps per request")
+	inspectDir := flag.String("inspect-dir", "", "specify directory to keep inspector captures across restarts")
+
+	balanceStrategy := flag.String("balance", "", "specify balancing strategy for -backend: round-robin, least-connections or random")
+	healthCheck := flag.Bool("health-check", false, "check -backend health and skip unhealthy ones")
+	healthPath := flag.String("health-path", "", "check health with http GET of the path instead of tcp connect")
+	healthInterval := flag.Duration("health-interval", 10*time.Second, "specify interval between health checks")
+	idleTimeout := flag.Duration("idle-timeout", 0, "close proxied connections without traffic for the duration, 0 disables it")
+	maxLifetime := flag.Duration("max-lifetime", 0, "close proxied connections after the duration, 0 disables it")
+	maxConnections := flag.Int("max-connections", 0, "specify max concurrent proxied connections, 0 is unlimited")
+	queueTimeout := flag.Duration("queue-timeout", 0, "keep connections over -max-connections waiting for the duration instead of rejecting them")
+	connectionsPerSecond := flag.Float64("connections-per-second", 0, "specify max new connections per second, 0 is unlimited")
+	bytesPerSecond := flag.Int64("bytes-per-second", 0, "specify max bytes per second of each connection, 0 is unlimited")
+	tunnelBytesPerSecond := flag.Int64("tunnel-bytes-per-second", 0, "specify max bytes per second of the whole tunnel, 0 is unlimited")
+	signedURLSecret := flag.String("signed-url-secret", "", "accept requests signed with the secret, http mode only")
+
+	var requestHeaders, responseHeaders, removeRequestHeaders, removeResponseHeaders, inspectRedact stringsFlag
+	var basicUsers, bearerTokens, backends stringsFlag
+	flag.Var(&backends, "backend", "balance between local backends, same format as -target, may be repeated")
+	flag.Var(&requestHeaders, "request-header", "add request header \"Name: value\", http mode only, may be repeated")
+	flag.Var(&responseHeaders, "response-header", "add response header \"Name: value\", http mode only, may be repeated")
+	flag.Var(&removeRequestHeaders, "remove-request-header", "remove request header, http mode only, may be repeated")
+	flag.Var(&removeResponseHeaders, "remove-response-header", "remove response header, http mode only, may be repeated")
+	flag.Var(&inspectRedact, "inspect-redact", "hide header value in the inspector besides Authorization, Proxy-Authorization, Cookie and Set-Cookie, may be repeated")
+	flag.Var(&basicUsers, "basic-user", "accept basic auth \"user:bcrypt-hash\", http mode only, may be repeated")
+	flag.Var(&bearerTokens, "bearer-token", "accept bearer token, http mode only, may be repeated")
 
 	flag.Parse()
 
-	fmt.Println(*command)
+	supervisorOptions := client.SupervisorOptions{
+		Restart:      *restart,
+		MaxRestarts:  *maxRestarts,
+		RestartDelay: *restartDelay,
+		ReadyTarget:  *readyTarget,
+		ReadyPath:    *readyPath,
+		StopTimeout:  *stopTimeout,
+	}
+
+	if *command != "" {
+		if flag.NArg() > 0 {
+			log.Fatal("specify command with -command or after --, not both")
+		}
+
+		var err error
+
+		supervisorOptions.Args, err = client.SplitCommand(*command)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		supervisorOptions.Args = flag.Args()
+	}
+
+	var cfg *client.AgentConfig
+
+	if *configPath != "" {
+		var err error
+
+		cfg, err = client.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *token == "" {
+			*token = cfg.Token
+		}
+
+		if *adminAddr == "" {
+			*adminAddr = cfg.AdminAddr
+		}
+
+		if *initHost == "" {
+			*initHost = cfg.Topology
+		}
+	}
 
 	if *token == "" {
 		*token = os.Getenv("PINGE_TOKEN")
-		if *token == "" {
+
+		// containers may have their own tokens in docker mode
+		if *token == "" && !*docker {
 			log.Fatal("token is empty")
 		}
 	}
 
+	if cfg != nil {
+		cfg.Token = *token
+
+		if err := cfg.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var options []client.ClientOption
+	var inspector *client.Inspector
+
+	if *inspect {
+		*httpMode = true
+
+		var err error
+
+		inspector, err = client.NewInspector(client.InspectorOptions{
+			Capacity:      *inspectCapacity,
+			MaxBodySize:   *inspectMaxBody,
+			RedactHeaders: inspectRedact,
+			Dir:           *inspectDir,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if cfg != nil && cfg.Inspector != nil {
+		var err error
+
+		inspector, err = client.NewInspector(*cfg.Inspector)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if inspector != nil {
+		if *adminAddr == "" {
+			log.Fatal("inspector requires admin address")
+		}
+
+		options = append(options, client.WithInspector(inspector))
+	}
+
+	var urls *client.TunnelURLs
+
+	if *docker {
+		urls = client.NewTunnelURLs(*dockerStateFile)
+	}
+
+	if *adminAddr != "" {
+		registry := client.NewRegistry()
+		options = append(options, client.WithRegistry(registry))
+
+		handler := client.NewAdminHandler(registry, inspector)
+
+		if urls != nil {
+			mux := http.NewServeMux()
+			mux.Handle("/", handler)
+			mux.Handle("/urls", http.StripPrefix("/urls", urls))
+			mux.Handle("/urls/", http.StripPrefix("/urls", urls))
+
+			handler = mux
+		}
+
+		go func() {
+			if err := http.ListenAndServe(*adminAddr, handler); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if *discoveryAddr != "" {
+		if urls == nil {
+			log.Fatal("discovery requires docker mode")
+		}
+
+		go func() {
+			if err := http.ListenAndServe(*discoveryAddr, urls); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	if *docker == true {
-		if err := client.DockerInit(*token, *initHost); err != nil {
+		dockerOptions := client.DockerOptions{
+			Host:         *dockerHost,
+			Runtime:      *containerRuntime,
+			Network:      *dockerNetwork,
+			Project:      *dockerProject,
+			NameTemplate: *dockerNameTemplate,
+			URLs:         urls,
+		}
+
+		if cfg != nil {
+			dockerOptions.Tokens = cfg.DockerTokens
+		}
+
+		if err := client.RunDocker(context.Background(), *token, *initHost, dockerOptions, options...); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if *kubernetes {
+		kubernetesOptions := client.KubernetesOptions{
+			Server:    *kubernetesServer,
+			Token:     *kubernetesToken,
+			CAFile:    *kubernetesCA,
+			Insecure:  *kubernetesInsecure,
+			Namespace: *kubernetesNamespace,
+		}
+
+		if err := client.RunKubernetes(context.Background(), *token, *initHost, kubernetesOptions, options...); err != nil {
 			log.Fatal(err)
 		}
 
 		return
 	}
 
+	if *initHost == "" {
+		*initHost = os.Getenv("PINGE_TOPOLOGY_HOST")
+	}
+
+	if cfg != nil {
+		cfg.Topology = *initHost
+
+		if supervisorOptions.ReadyTarget == "" && len(cfg.Tunnels) > 0 {
+			tunnel := cfg.Tunnels[0]
+			supervisorOptions.ReadyTarget = tunnel.TargetURL()
+
+			if tunnel.Balancer != nil && len(tunnel.Balancer.Backends) > 0 {
+				supervisorOptions.ReadyTarget = tunnel.Balancer.Backends[0]
+			}
+		}
+
+		supervisor := newSupervisor(supervisorOptions)
+		if supervisor != nil {
+			options = append(options, client.WithReadiness(supervisor.WaitReady))
+		}
+
+		supervise(supervisor, func() error {
+			agent, err := client.NewAgent(context.Background(), cfg, options...)
+			if err != nil {
+				return err
+			}
+
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+
+			go agent.WatchConfig(*configPath, 2*time.Second, reload)
+
+			agent.Wait()
+
+			return nil
+		})
+
+		return
+	}
+
 	if *serviceName == "" {
 		*serviceName = os.Getenv("PINGE_SERVICE_NAME")
 		if *serviceName == "" {
@@ -49,18 +330,54 @@ func main() {
 		}
 	}
 
-	if *port == "" {
+	if *target == "" {
+		*target = os.Getenv("PINGE_TARGET")
+	}
+
+	if *target == "" && *port == "" && len(backends) == 0 {
 		*port = os.Getenv("PINGE_PORT")
 		if *port == "" {
 			log.Fatal("port is empty")
 		}
 	}
 
-	if *initHost == "" {
-		*initHost = os.Getenv("PINGE_TOPOLOGY_HOST")
+	if *target == "" {
+		*target = net.JoinHostPort("localhost", *port)
 	}
 
-	var options []client.ClientOption
+	if *idleTimeout > 0 {
+		options = append(options, client.WithIdleTimeout(*idleTimeout))
+	}
+
+	if *maxLifetime > 0 {
+		options = append(options, client.WithMaxLifetime(*maxLifetime))
+	}
+
+	if *maxConnections > 0 || *connectionsPerSecond > 0 || *bytesPerSecond > 0 || *tunnelBytesPerSecond > 0 {
+		options = append(options, client.WithLimits(client.LimitOptions{
+			MaxConnections:       *maxConnections,
+			QueueTimeout:         client.Duration(*queueTimeout),
+			ConnectionsPerSecond: *connectionsPerSecond,
+			BytesPerSecond:       *bytesPerSecond,
+			TunnelBytesPerSecond: *tunnelBytesPerSecond,
+		}))
+	}
+
+	if len(backends) > 0 {
+		balancerOptions := client.BalancerOptions{
+			Backends: backends,
+			Strategy: *balanceStrategy,
+		}
+
+		if *healthCheck || *healthPath != "" {
+			balancerOptions.HealthCheck = &client.HealthCheckOptions{
+				Path:     *healthPath,
+				Interval: client.Duration(*healthInterval),
+			}
+		}
+
+		options = append(options, client.WithBalancer(balancerOptions))
+	}
 
 	if *host != "" {
 		options = append(options, client.WithGateHost(*host))
@@ -78,24 +395,148 @@ func main() {
 		options = append(options, client.WithCustomDomain(*customDomain))
 	}
 
-	if *command != "" {
-		go execCommand(*command)
+	if *httpMode {
+		httpOptions := client.HTTPOptions{
+			RewriteHost:           *rewriteHost,
+			ForwardedHeaders:      *forwardedHeaders,
+			RemoveRequestHeaders:  removeRequestHeaders,
+			RemoveResponseHeaders: removeResponseHeaders,
+		}
+
+		var err error
+
+		if httpOptions.RequestHeaders, err = parseHeaders(requestHeaders); err != nil {
+			log.Fatal(err)
+		}
+
+		if httpOptions.ResponseHeaders, err = parseHeaders(responseHeaders); err != nil {
+			log.Fatal(err)
+		}
+
+		options = append(options, client.WithHTTP(httpOptions))
 	}
 
-	if err := client.InitService(context.Background(), *serviceName, *token, "localhost", *port, options); err != nil {
+	if len(basicUsers) > 0 || len(bearerTokens) > 0 || *signedURLSecret != "" {
+		authOptions := client.AuthOptions{
+			BasicUsers:      make(map[string]string),
+			BearerTokens:    bearerTokens,
+			SignedURLSecret: *signedURLSecret,
+		}
+
+		for _, user := range basicUsers {
+			i := strings.Index(user, ":")
+			if i <= 0 {
+				log.Fatalf("basic user %q must be in \"user:bcrypt-hash\" form", user)
+			}
+
+			authOptions.BasicUsers[user[:i]] = user[i+1:]
+		}
+
+		options = append(options, client.WithAuth(authOptions))
+	}
+
+	if supervisorOptions.ReadyTarget == "" {
+		supervisorOptions.ReadyTarget = *target
+
+		if len(backends) > 0 {
+			supervisorOptions.ReadyTarget = backends[0]
+		}
+	}
+
+	supervisor := newSupervisor(supervisorOptions)
+	if supervisor != nil {
+		options = append(options, client.WithReadiness(supervisor.WaitReady))
+	}
+
+	supervise(supervisor, func() error {
+		return client.InitServiceTarget(context.Background(), *serviceName, *token, *target, options)
+	})
+}
+
+func newSupervisor(options client.SupervisorOptions) *client.Supervisor {
+	if len(options.Args) == 0 {
+		return nil
+	}
+
+	supervisor, err := client.NewSupervisor(options)
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	return supervisor
 }
 
-func execCommand(commandString string) {
-	parts := strings.Split(commandString, " ")
+// supervise runs the tunnels once the command is ready and exits with the
+// exit code of the command, SIGINT and SIGTERM are forwarded to it. When the
+// tunnels fail the command is stopped first, the agent exits with 1 if the
+// command exits with 0 then. Without a command it just runs the tunnels.
+func supervise(supervisor *client.Supervisor, run func() error) {
+	if supervisor == nil {
+		if err := run(); err != nil {
+			log.Fatal(err)
+		}
 
-	command := exec.Command(parts[0], parts[1:]...)
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
+		return
+	}
 
-	if err := command.Run(); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			supervisor.Signal(sig)
+		}
+	}()
+
+	var failed int32
+
+	go func() {
+		if err := supervisor.WaitReady(context.Background()); err != nil {
+			return
+		}
+
+		if err := run(); err != nil {
+			fmt.Println("tunnel failed, stop command:", err)
+
+			atomic.StoreInt32(&failed, 1)
+			supervisor.Signal(syscall.SIGTERM)
+		}
+	}()
+
+	code, err := supervisor.Run(context.Background())
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if code == 0 && atomic.LoadInt32(&failed) == 1 {
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func parseHeaders(values []string) (map[string]string, error) {
+	headers := make(map[string]string)
+
+	for _, value := range values {
+		i := strings.Index(value, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("header %q must be in \"Name: value\" form", value)
+		}
+
+		headers[strings.TrimSpace(value[:i])] = strings.TrimSpace(value[i+1:])
 	}
+
+	return headers, nil
 }
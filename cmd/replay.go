@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	client "github.com/pinge-link/sdk"
+)
+
+// replay asks the admin api of a running agent to send a captured request
+// again, e.g. pinge-agent replay -header "X-Debug: 1" 42
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+
+	adminAddr := flags.String("admin-addr", "127.0.0.1:4040", "specify admin address of the running agent")
+	bodyFile := flags.String("body-file", "", "replace request body with the file content")
+
+	var headers, removeHeaders stringsFlag
+	flags.Var(&headers, "header", "set request header \"Name: value\", may be repeated")
+	flags.Var(&removeHeaders, "remove-header", "remove request header, may be repeated")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: pinge-agent replay [flags] <id>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	id := flags.Arg(0)
+
+	edit := client.ReplayEdit{
+		RemoveHeaders: removeHeaders,
+	}
+
+	var err error
+
+	if edit.Header, err = parseHeaders(headers); err != nil {
+		return err
+	}
+
+	if *bodyFile != "" {
+		b, err := os.ReadFile(*bodyFile)
+		if err != nil {
+			return err
+		}
+
+		body := string(b)
+		edit.Body = &body
+	}
+
+	b, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Post("http://"+*adminAddr+"/inspect/api/requests/"+id+"/replay", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("replay %s: %s", id, bytes.TrimSpace(msg))
+	}
+
+	var result client.Replay
+
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	if result.Error != "" {
+		return fmt.Errorf("replay %s: %s", id, result.Error)
+	}
+
+	fmt.Printf("HTTP %d (%s)\r\n", result.Response.StatusCode, result.Duration)
+
+	for name, values := range result.Response.Header {
+		for _, value := range values {
+			fmt.Printf("%s: %s\r\n", name, value)
+		}
+	}
+
+	fmt.Println()
+	os.Stdout.Write(result.Response.Body)
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	client "github.com/pinge-link/sdk"
+)
+
+// serveDir shares a directory through the tunnel without a local server,
+// e.g. pinge-agent serve-dir -service-name docs -spa ./dist
+func serveDir(args []string) error {
+	flags := flag.NewFlagSet("serve-dir", flag.ExitOnError)
+
+	serviceName := flags.String("service-name", os.Getenv("PINGE_SERVICE_NAME"), "specity service name")
+	token := flags.String("token", os.Getenv("PINGE_TOKEN"), "specity token for pinge.link")
+	initHost := flags.String("init-host", os.Getenv("PINGE_TOPOLOGY_HOST"), "specify init host")
+	private := flags.Bool("private", false, "access to service by token")
+	customDomain := flags.String("custom-domain", "", "specify custom domain for service")
+	spa := flags.Bool("spa", false, "serve index.html for missing paths")
+	noListing := flags.Bool("no-listing", false, "do not list directories without index.html")
+	noGzip := flags.Bool("no-gzip", false, "do not compress responses")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: pinge-agent serve-dir [flags] <dir>")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	dir := flags.Arg(0)
+
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if *token == "" {
+		return fmt.Errorf("token is empty")
+	}
+
+	if *serviceName == "" {
+		return fmt.Errorf("service name is empty")
+	}
+
+	var options []client.ClientOption
+
+	if *initHost != "" {
+		options = append(options, client.WithTopologyAddress(*initHost))
+	}
+
+	if *private {
+		options = append(options, client.WithPrivate())
+	}
+
+	if *customDomain != "" {
+		options = append(options, client.WithCustomDomain(*customDomain))
+	}
+
+	ctx := context.Background()
+
+	c, err := client.InitClient(ctx, *serviceName, *token, options...)
+	if err != nil {
+		return err
+	}
+
+	handler := client.NewDirHandler(dir, client.DirOptions{
+		Listing: !*noListing,
+		SPA:     *spa,
+		Gzip:    !*noGzip,
+	})
+
+	return client.ServeHandler(ctx, c, handler)
+}
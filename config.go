@@ -0,0 +1,179 @@
+package pinge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+var serviceNameRe = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// AgentConfig describes every tunnel the agent runs. It is read from a json
+// file passed with the -config flag. The inspector records the traffic of
+// the tunnels running in http mode. The docker tokens are used by the
+// -docker mode.
+type AgentConfig struct {
+	Token        string            `json:"token,omitempty"`
+	Topology     string            `json:"topology,omitempty"`
+	AdminAddr    string            `json:"admin_addr,omitempty"`
+	Inspector    *InspectorOptions `json:"inspector,omitempty"`
+	Tunnels      []TunnelConfig    `json:"tunnels"`
+	DockerTokens []DockerToken     `json:"docker_tokens,omitempty"`
+}
+
+type TunnelConfig struct {
+	Name         string           `json:"name"`
+	Host         string           `json:"host,omitempty"`
+	Port         string           `json:"port,omitempty"`
+	Target       string           `json:"target,omitempty"`
+	Token        string           `json:"token,omitempty"`
+	Private      bool             `json:"private,omitempty"`
+	CustomDomain string           `json:"custom_domain,omitempty"`
+	HTTP         *HTTPOptions     `json:"http,omitempty"`
+	Auth         *AuthOptions     `json:"auth,omitempty"`
+	Balancer     *BalancerOptions `json:"balancer,omitempty"`
+	IdleTimeout  Duration         `json:"idle_timeout,omitempty"`
+	MaxLifetime  Duration         `json:"max_lifetime,omitempty"`
+	Limits       *LimitOptions    `json:"limits,omitempty"`
+}
+
+// LoadConfig reads the config file. It is not validated yet: the token and
+// the topology may come from flags or the environment, Validate runs once
+// they are merged in.
+func LoadConfig(path string) (*AgentConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AgentConfig
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse config %s: %w", path, err)
+	}
+
+	for i := range cfg.Tunnels {
+		if cfg.Tunnels[i].Host == "" {
+			cfg.Tunnels[i].Host = "localhost"
+		}
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *AgentConfig) Validate() error {
+	if len(cfg.Tunnels) == 0 && len(cfg.DockerTokens) == 0 {
+		return fmt.Errorf("config has no tunnels")
+	}
+
+	for i, token := range cfg.DockerTokens {
+		if token.Token == "" {
+			return fmt.Errorf("docker token %d: token is empty", i)
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for _, tunnel := range cfg.Tunnels {
+		if !serviceNameRe.MatchString(tunnel.Name) {
+			return fmt.Errorf("tunnel name %q must contain English letters, digits and dashes only", tunnel.Name)
+		}
+
+		if names[tunnel.Name] {
+			return fmt.Errorf("tunnel %s is declared twice", tunnel.Name)
+		}
+
+		names[tunnel.Name] = true
+
+		if tunnel.Port == "" && tunnel.Target == "" && tunnel.Balancer == nil {
+			return fmt.Errorf("tunnel %s: port is empty", tunnel.Name)
+		}
+
+		if tunnel.Target != "" {
+			if _, err := ParseTarget(tunnel.Target); err != nil {
+				return fmt.Errorf("tunnel %s: %w", tunnel.Name, err)
+			}
+		}
+
+		if tunnel.Token == "" && cfg.Token == "" {
+			return fmt.Errorf("tunnel %s: token is empty", tunnel.Name)
+		}
+	}
+
+	return nil
+}
+
+// TargetURL returns the target of the tunnel, built from host and port when
+// it is not set.
+func (t TunnelConfig) TargetURL() string {
+	if t.Target != "" {
+		return t.Target
+	}
+
+	return net.JoinHostPort(t.Host, t.Port)
+}
+
+func (t TunnelConfig) Options() []ClientOption {
+	var options []ClientOption
+
+	if t.Private {
+		options = append(options, WithPrivate())
+	}
+
+	if t.CustomDomain != "" {
+		options = append(options, WithCustomDomain(t.CustomDomain))
+	}
+
+	if t.HTTP != nil {
+		options = append(options, WithHTTP(*t.HTTP))
+	}
+
+	if t.Auth != nil {
+		options = append(options, WithAuth(*t.Auth))
+	}
+
+	if t.Balancer != nil {
+		options = append(options, WithBalancer(*t.Balancer))
+	}
+
+	if t.IdleTimeout > 0 {
+		options = append(options, WithIdleTimeout(time.Duration(t.IdleTimeout)))
+	}
+
+	if t.MaxLifetime > 0 {
+		options = append(options, WithMaxLifetime(time.Duration(t.MaxLifetime)))
+	}
+
+	if t.Limits != nil {
+		options = append(options, WithLimits(*t.Limits))
+	}
+
+	return options
+}
+
+// Duration is a time.Duration written as "10s" or "1m30s" in the config.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
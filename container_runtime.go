@@ -0,0 +1,143 @@
+package pinge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// ContainerRuntime lists, inspects and watches the containers of a
+// container engine.
+type ContainerRuntime interface {
+	// List returns the containers with all the labels, given as key=value
+	// or key.
+	List(ctx context.Context, labels ...string) ([]DockerContainer, error)
+
+	// Inspect returns nil when the container does not exist.
+	Inspect(ctx context.Context, id string) (*DockerContainer, error)
+
+	// Events streams the container events until the context is done or
+	// the engine closes the stream.
+	Events(ctx context.Context) (<-chan *DockerContainerEvent, error)
+
+	// ReadFile reads a regular file of at most limit bytes inside the
+	// container, without access to the file system of the host.
+	ReadFile(ctx context.Context, id string, path string, limit int64) ([]byte, error)
+}
+
+// NewContainerRuntime connects to the engine at the host in DOCKER_HOST
+// format. Without a host it uses DOCKER_HOST, or the first socket of docker
+// or podman found. The name is docker or podman, the engine is detected
+// when it is empty.
+func NewContainerRuntime(ctx context.Context, name string, host string) (ContainerRuntime, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+
+	if host == "" {
+		host = detectRuntimeSocket(runtimeSockets())
+	}
+
+	api, err := newDockerAPI(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.negotiate(ctx); err != nil {
+		return nil, fmt.Errorf("cannot negotiate api version with %s: %w", host, err)
+	}
+
+	switch name {
+	case "":
+		if api.podman {
+			return &podmanRuntime{api}, nil
+		}
+
+		return api, nil
+	case "docker":
+		return api, nil
+	case "podman":
+		return &podmanRuntime{api}, nil
+	}
+
+	return nil, fmt.Errorf("unknown container runtime %s", name)
+}
+
+// runtimeSockets returns the sockets of rootful docker, rootless podman and
+// rootful podman.
+func runtimeSockets() []string {
+	sockets := []string{"/var/run/docker.sock"}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+
+	return append(sockets, "/run/podman/podman.sock")
+}
+
+// detectRuntimeSocket returns the first socket accepting connections, the
+// docker socket when none does.
+func detectRuntimeSocket(sockets []string) string {
+	for _, socket := range sockets {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			continue
+		}
+
+		conn.Close()
+
+		return "unix://" + socket
+	}
+
+	return dockerHostDefault
+}
+
+// podmanRuntime is the docker compatible api of podman, which names some
+// events after podman ones.
+type podmanRuntime struct {
+	*dockerAPI
+}
+
+var podmanActions = map[string]string{
+	"died":    "die",
+	"remove":  "destroy",
+	"cleanup": "",
+	"init":    "",
+}
+
+func (p *podmanRuntime) Events(ctx context.Context) (<-chan *DockerContainerEvent, error) {
+	events, err := p.dockerAPI.Events(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *DockerContainerEvent)
+
+	go func() {
+		defer close(ch)
+
+		for event := range events {
+			if event.Action == "" {
+				event.Action = event.Status
+			}
+
+			if action, ok := podmanActions[event.Action]; ok {
+				if action == "" {
+					continue
+				}
+
+				event.Action = action
+			}
+
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
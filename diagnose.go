@@ -0,0 +1,389 @@
+package pinge
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DiagnoseOptions struct {
+	ServiceName     string
+	Token           string
+	TopologyAddress string
+	// PublicURL overrides the url built from the uri sent by the gate, the
+	// load generator sends its requests there.
+	PublicURL string
+	// TCP serves the diagnostics backend on a local port behind a raw tcp
+	// tunnel, the way the agent runs without -http, instead of serving it on
+	// the tunnel directly.
+	TCP         bool
+	Timeout     time.Duration
+	Load        bool
+	Requests    int
+	Concurrency int
+	Size        int
+	Options     []ClientOption
+}
+
+type DiagnoseReport struct {
+	Region    string          `json:"region"`
+	Probes    []TopologyProbe `json:"probes"`
+	PublicURL string          `json:"public_url"`
+	Timings   DiagnoseTimings `json:"timings"`
+	Load      *LoadReport     `json:"load,omitempty"`
+}
+
+type DiagnoseTimings struct {
+	Topology     time.Duration `json:"topology"`
+	SelectRegion time.Duration `json:"select_region"`
+	Connect      time.Duration `json:"connect"`
+	ServiceURI   time.Duration `json:"service_uri"`
+	Echo         time.Duration `json:"echo"`
+}
+
+type LoadReport struct {
+	Requests   int           `json:"requests"`
+	Errors     int           `json:"errors"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+	Throughput float64       `json:"throughput"`
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	FirstError string        `json:"first_error,omitempty"`
+}
+
+// Diagnose checks the whole path through the tunnel: it prints the region
+// probes, brings up a temporary tunnel backed by NewDiagnosticsHandler, echoes
+// a payload through the public url and optionally measures it with a load
+// generator hitting the public url.
+func Diagnose(ctx context.Context, options DiagnoseOptions) (*DiagnoseReport, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+
+	session, err := NewSession(ctx, options.TopologyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	report := DiagnoseReport{
+		Region: session.Region(),
+		Probes: session.Probes(),
+		Timings: DiagnoseTimings{
+			Topology:     session.Timings().Topology,
+			SelectRegion: session.Timings().SelectRegion,
+		},
+	}
+
+	startTime := time.Now()
+
+	clientOptions := append([]ClientOption{WithSession(session)}, options.Options...)
+
+	client, err := InitClient(ctx, options.ServiceName, options.Token, clientOptions...)
+	if err != nil {
+		return &report, err
+	}
+
+	defer client.Close()
+
+	report.Timings.Connect = time.Since(startTime)
+
+	if options.TCP {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return &report, err
+		}
+
+		server := &http.Server{Handler: NewDiagnosticsHandler()}
+		defer server.Close()
+
+		go server.Serve(listener)
+		go serveTarget(ctx, client, listener.Addr().String())
+	} else {
+		go ServeHandler(ctx, client, NewDiagnosticsHandler())
+	}
+
+	uri, err := client.WaitURI(ctx)
+	if err != nil {
+		return &report, fmt.Errorf("gate did not send service uri: %w", err)
+	}
+
+	report.Timings.ServiceURI = time.Since(startTime)
+
+	report.PublicURL = "https://" + uri
+	if options.PublicURL != "" {
+		report.PublicURL = options.PublicURL
+	}
+
+	echoTime := time.Now()
+
+	if err := echoRequest(ctx, report.PublicURL); err != nil {
+		return &report, fmt.Errorf("echo through the tunnel: %w", err)
+	}
+
+	report.Timings.Echo = time.Since(echoTime)
+
+	if options.Load {
+		report.Load = runLoad(ctx, report.PublicURL, options)
+	}
+
+	return &report, nil
+}
+
+func runLoad(ctx context.Context, publicURL string, options DiagnoseOptions) *LoadReport {
+	if options.Requests <= 0 {
+		options.Requests = 100
+	}
+
+	if options.Concurrency <= 0 {
+		options.Concurrency = 10
+	}
+
+	if options.Size <= 0 {
+		options.Size = 64 << 10
+	}
+
+	url := strings.TrimSuffix(publicURL, "/") + "/bytes?n=" + strconv.Itoa(options.Size)
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+
+	report := LoadReport{
+		Requests: options.Requests,
+	}
+
+	jobs := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	startTime := time.Now()
+
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range jobs {
+				requestTime := time.Now()
+
+				n, err := loadRequest(ctx, url)
+
+				mu.Lock()
+				if err != nil {
+					report.Errors++
+					if report.FirstError == "" {
+						report.FirstError = err.Error()
+					}
+				} else {
+					report.Bytes += n
+					latencies = append(latencies, time.Since(requestTime))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < options.Requests; i++ {
+		jobs <- struct{}{}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	report.Duration = time.Since(startTime)
+	report.Throughput = float64(report.Bytes) / report.Duration.Seconds()
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	report.P50 = percentile(latencies, 50)
+	report.P90 = percentile(latencies, 90)
+	report.P99 = percentile(latencies, 99)
+
+	return &report
+}
+
+func loadRequest(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	n, err := io.Copy(io.Discard, res.Body)
+	if err != nil {
+		return n, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return n, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return n, nil
+}
+
+// echoRequest sends a payload to /echo and checks that it comes back whole.
+func echoRequest(ctx context.Context, publicURL string) error {
+	payload := make([]byte, 64<<10)
+	if _, err := rand.Read(payload); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(publicURL, "/")+"/echo", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	if !bytes.Equal(b, payload) {
+		return fmt.Errorf("got %d bytes back instead of the %d sent", len(b), len(payload))
+	}
+
+	return nil
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+const maxEchoSize = 32 << 20
+
+// NewDiagnosticsHandler answers with the request as json on /, echoes the
+// body of up to 32 MiB on /echo and sends n bytes on /bytes?n=.
+func NewDiagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"method":      r.Method,
+			"url":         r.URL.String(),
+			"host":        r.Host,
+			"proto":       r.Proto,
+			"remote_addr": r.RemoteAddr,
+			"header":      r.Header,
+			"time":        time.Now(),
+		})
+	})
+
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		// the server stops reading the body once the response is flushed, so
+		// the body is read whole before the answer
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEchoSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/bytes", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 0 || n > 1<<30 {
+			http.Error(w, "n must be between 0 and 1073741824", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+
+		chunk := make([]byte, 32*1024)
+		for n > 0 {
+			size := len(chunk)
+			if n < size {
+				size = n
+			}
+
+			if _, err := w.Write(chunk[:size]); err != nil {
+				return
+			}
+
+			n -= size
+		}
+	})
+
+	return mux
+}
+
+func (r *DiagnoseReport) Print(w io.Writer) {
+	fmt.Fprintln(w, "region probes:")
+
+	for _, probe := range r.Probes {
+		status := probe.RTT.String()
+		if probe.Error != "" {
+			status = "error: " + probe.Error
+		}
+
+		mark := " "
+		if probe.Region == r.Region {
+			mark = "*"
+		}
+
+		fmt.Fprintf(w, " %s %-12s %-32s %s\n", mark, probe.Region, probe.PingHost, status)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "public url:    %s\n", r.PublicURL)
+	fmt.Fprintf(w, "topology:      %s\n", r.Timings.Topology)
+	fmt.Fprintf(w, "select region: %s\n", r.Timings.SelectRegion)
+	fmt.Fprintf(w, "connect:       %s\n", r.Timings.Connect)
+	fmt.Fprintf(w, "service uri:   %s\n", r.Timings.ServiceURI)
+	fmt.Fprintf(w, "echo:          %s\n", r.Timings.Echo)
+
+	if r.Load != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "requests:      %d, errors %d\n", r.Load.Requests, r.Load.Errors)
+		fmt.Fprintf(w, "throughput:    %.1f KiB/s\n", r.Load.Throughput/1024)
+		fmt.Fprintf(w, "latency:       p50 %s, p90 %s, p99 %s\n", r.Load.P50, r.Load.P90, r.Load.P99)
+
+		if r.Load.FirstError != "" {
+			fmt.Fprintf(w, "first error:   %s\n", r.Load.FirstError)
+		}
+	}
+}
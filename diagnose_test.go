@@ -0,0 +1,137 @@
+package pinge
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+// newPublicEndpoint listens on a local port and passes its connections to the
+// service through the gate, like the public url of the service.
+func newPublicEndpoint(t *testing.T, gate *pingetest.Gate, service string) string {
+	ctx := testContext(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				tunnelConn, err := gate.Dial(ctx, service)
+				if err != nil {
+					return
+				}
+
+				defer tunnelConn.Close()
+
+				go io.Copy(tunnelConn, conn)
+				io.Copy(conn, tunnelConn)
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String()
+}
+
+func TestDiagnose(t *testing.T) {
+	for _, tcp := range []bool{false, true} {
+		gate := newTestGate(t)
+		topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+		report, err := Diagnose(testContext(t), DiagnoseOptions{
+			ServiceName:     "diagnose",
+			Token:           "token",
+			TopologyAddress: topology.URL(),
+			PublicURL:       newPublicEndpoint(t, gate, "diagnose"),
+			TCP:             tcp,
+			Load:            true,
+			Requests:        20,
+			Concurrency:     4,
+			Size:            1000,
+		})
+		if err != nil {
+			t.Fatalf("tcp %v: %v", tcp, err)
+		}
+
+		if report.Region != "local" || report.Timings.Echo <= 0 {
+			t.Fatalf("tcp %v: unexpected report %+v", tcp, report)
+		}
+
+		if report.Load.Errors != 0 || report.Load.Bytes != 20*1000 {
+			t.Fatalf("tcp %v: unexpected load %+v", tcp, report.Load)
+		}
+
+		var out bytes.Buffer
+		report.Print(&out)
+
+		if !strings.Contains(out.String(), "* local") {
+			t.Fatalf("tcp %v: selected region is not marked in\n%s", tcp, out.String())
+		}
+	}
+}
+
+func TestDiagnoseBrokenTunnel(t *testing.T) {
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	// the public url answers, but not from the tunnel
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("something else"))
+	}))
+	defer server.Close()
+
+	_, err := Diagnose(testContext(t), DiagnoseOptions{
+		ServiceName:     "diagnose",
+		Token:           "token",
+		TopologyAddress: topology.URL(),
+		PublicURL:       server.URL,
+	})
+	if err == nil || !strings.Contains(err.Error(), "echo") {
+		t.Fatalf("got %v, want a failed echo", err)
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	server := httptest.NewServer(NewDiagnosticsHandler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/bytes?n=100000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || len(b) != 100000 {
+		t.Fatalf("got %d with %d bytes", res.StatusCode, len(b))
+	}
+
+	res, err = http.Get(server.URL + "/bytes?n=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %d for a negative size", res.StatusCode)
+	}
+}
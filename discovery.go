@@ -0,0 +1,219 @@
+package pinge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TunnelURLs collects the public urls of the container tunnels, writes them
+// to a state file and serves them over http, so that the containers learn
+// their own external urls.
+type TunnelURLs struct {
+	statePath string
+
+	mu         sync.RWMutex
+	containers map[string]*ContainerURLs
+}
+
+type ContainerURLs struct {
+	Name     string            `json:"name"`
+	IPs      []string          `json:"ips,omitempty"`
+	Services map[string]string `json:"services"`
+}
+
+// NewTunnelURLs keeps the state file at the path up to date, no file is
+// written when the path is empty.
+func NewTunnelURLs(statePath string) *TunnelURLs {
+	return &TunnelURLs{
+		statePath:  statePath,
+		containers: make(map[string]*ContainerURLs),
+	}
+}
+
+// URLs returns the urls by container id and service.
+func (u *TunnelURLs) URLs() map[string]ContainerURLs {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	urls := make(map[string]ContainerURLs, len(u.containers))
+
+	for id, container := range u.containers {
+		copied := *container
+		copied.Services = make(map[string]string, len(container.Services))
+
+		for service, url := range container.Services {
+			copied.Services[service] = url
+		}
+
+		urls[id] = copied
+	}
+
+	return urls
+}
+
+func (u *TunnelURLs) set(container DockerContainer, service string, uri string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	urls, ok := u.containers[container.ID]
+	if !ok {
+		urls = &ContainerURLs{
+			Name:     container.GetName(),
+			Services: make(map[string]string),
+		}
+
+		for _, network := range container.NetworkSettings.Networks {
+			if network.IPAddress != "" {
+				urls.IPs = append(urls.IPs, network.IPAddress)
+			}
+		}
+
+		u.containers[container.ID] = urls
+	}
+
+	urls.Services[service] = "https://" + uri
+
+	u.save()
+}
+
+func (u *TunnelURLs) remove(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.containers[id]; !ok {
+		return
+	}
+
+	delete(u.containers, id)
+
+	u.save()
+}
+
+// save replaces the state file, so readers never see it half written.
+func (u *TunnelURLs) save() {
+	if u.statePath == "" {
+		return
+	}
+
+	b, err := json.MarshalIndent(u.containers, "", "  ")
+	if err != nil {
+		fmt.Println("cannot encode tunnel urls", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(u.statePath), filepath.Base(u.statePath)+".*")
+	if err != nil {
+		fmt.Println("cannot write tunnel urls", err)
+		return
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		fmt.Println("cannot write tunnel urls", err)
+		return
+	}
+
+	if err := tmp.Close(); err != nil {
+		fmt.Println("cannot write tunnel urls", err)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), u.statePath); err != nil {
+		fmt.Println("cannot write tunnel urls", err)
+	}
+}
+
+// find returns the container by id, short id or name.
+func (u *TunnelURLs) find(key string) (*ContainerURLs, bool) {
+	for id, container := range u.containers {
+		if id == key || container.Name == key || len(key) >= 12 && strings.HasPrefix(id, key) {
+			return container, true
+		}
+	}
+
+	return nil, false
+}
+
+// findIP returns the container with the ip.
+func (u *TunnelURLs) findIP(ip string) (*ContainerURLs, bool) {
+	for _, container := range u.containers {
+		if contains(container.IPs, ip) {
+			return container, true
+		}
+	}
+
+	return nil, false
+}
+
+// addrIP returns the ip of the host:port address.
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return net.ParseIP(host)
+}
+
+// ServeHTTP serves the urls of every container at /, the services of a
+// container at /<container> and the url of a service as text at
+// /<container>/<service>, where the container is its id, short id or name.
+// The container sending the request is found by its ip at /self.
+func (u *TunnelURLs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+
+	if path == "" {
+		writeJSON(w, u.URLs())
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 2)
+
+	u.mu.RLock()
+
+	var container *ContainerURLs
+	var ok bool
+
+	if parts[0] == "self" {
+		container, ok = u.findIP(addrIP(r.RemoteAddr).String())
+	} else {
+		container, ok = u.find(parts[0])
+	}
+
+	var services map[string]string
+	if ok {
+		services = make(map[string]string, len(container.Services))
+		for service, url := range container.Services {
+			services[service] = url
+		}
+	}
+
+	u.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, "container not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, services)
+		return
+	}
+
+	url, ok := services[parts[1]]
+	if !ok {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, url)
+}
@@ -2,216 +2,910 @@ package pinge
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
-
-	"golang.org/x/sync/errgroup"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 )
 
-func DockerInit(token string, initHost string) error {
-	return getContainers("/var/run/docker.sock", token, initHost)
+type DockerOptions struct {
+	// Host is the docker daemon in DOCKER_HOST format, the DOCKER_HOST
+	// variable or the local socket of docker or podman by default.
+	Host string
+
+	// Runtime is docker or podman, detected by default.
+	Runtime string
+
+	// Network is the network shared by the agent and the containers when
+	// the agent runs in a container, the networks of the agent container
+	// are detected by default.
+	Network string
+
+	// Project exposes only the containers of the docker-compose project.
+	Project string
+
+	// NameTemplate builds the service names, e.g. {{.Project}}-{{.Service}},
+	// from the compose Project and Service, the Container name and the Name
+	// given by the labels. Characters other than letters, digits and dashes
+	// are replaced with dashes.
+	NameTemplate string
+
+	// URLs collects the public urls of the container tunnels.
+	URLs *TunnelURLs
+
+	// Tokens are used instead of the agent token for the containers they
+	// select, the first matching one wins. The pingeTokenFile and
+	// pingeTokenEnv labels of a container take precedence over them.
+	Tokens []DockerToken
+}
+
+// DockerToken is the token of the containers matching the selector, a comma
+// separated list of key=value or key labels, e.g.
+// com.docker.compose.project=shop,team.
+type DockerToken struct {
+	Selector string `json:"selector"`
+	Token    string `json:"token"`
+}
+
+func DockerInit(token string, initHost string, options ...ClientOption) error {
+	return RunDocker(context.Background(), token, initHost, DockerOptions{}, options...)
 }
 
-func watchContainer(ctx context.Context, dockerSockPath string, containerName string) (chan *DockerContainerEvent, error) {
-	httpc := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial("unix", dockerSockPath)
-			},
-		},
+// RunDocker exposes the labelled containers of the docker daemon until the
+// context is done.
+func RunDocker(ctx context.Context, token string, initHost string, dockerOptions DockerOptions, options ...ClientOption) error {
+	runtime, err := NewContainerRuntime(ctx, dockerOptions.Runtime, dockerOptions.Host)
+	if err != nil {
+		return err
 	}
 
-	var filter string
+	r := newDockerReconciler(runtime, token, initHost, options)
+	r.project = dockerOptions.Project
+	r.urls = dockerOptions.URLs
+	r.tokens = dockerOptions.Tokens
+
+	if dockerOptions.NameTemplate != "" {
+		if r.nameTemplate, err = template.New("name").Option("missingkey=error").Parse(dockerOptions.NameTemplate); err != nil {
+			return fmt.Errorf("invalid service name template: %w", err)
+		}
+	}
 
-	if containerName != "" {
-		filter = `filters={"container":["` + containerName + `"]}`
+	if dockerOptions.Network != "" {
+		r.networks = []string{dockerOptions.Network}
+	} else if r.networks, err = agentNetworks(ctx, runtime); err != nil {
+		return err
 	}
 
-	res, err := httpc.Get("http://unix/v1.24/events?" + filter)
+	return r.run(ctx)
+}
+
+// agentNetworks returns the networks of the container the agent runs in,
+// nil when it runs on the host.
+func agentNetworks(ctx context.Context, runtime ContainerRuntime) ([]string, error) {
+	if _, err := os.Stat("/.dockerenv"); err != nil {
+		return nil, nil
+	}
+
+	// docker sets the hostname to the short id of the container
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, nil
+	}
+
+	container, err := runtime.Inspect(ctx, hostname)
 	if err != nil {
 		return nil, err
 	}
 
-	ch := make(chan *DockerContainerEvent)
+	if container == nil {
+		return nil, nil
+	}
 
-	go func() {
-		defer res.Body.Close()
+	var networks []string
+	for name := range container.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
 
-		dec := json.NewDecoder(res.Body)
+	sort.Strings(networks)
 
-		for {
-			var event DockerContainerEvent
+	fmt.Println("agent runs in container", hostname, "on networks", strings.Join(networks, ", "))
 
-			select {
-			case <-ctx.Done():
-				fmt.Println("stop listen container events")
-				return
-			default:
+	return networks, nil
+}
+
+// containerService is one tunnel of a container.
+type containerService struct {
+	Name         string
+	Host         string
+	Port         string
+	Private      bool
+	CustomDomain string
+}
+
+// knownServiceLabels are the fields of pinge.<name>.<field> labels.
+var knownServiceLabels = map[string]bool{
+	"port":          true,
+	"host-port":     true,
+	"private":       true,
+	"custom-domain": true,
+}
+
+// containerServices reads the services of the container from its labels.
+// A single service is described by pingeService with pingePort (a port of
+// the host) or pingeContainerPort, pingePrivate and pingeCustomDomain. Any
+// number of services are described by pinge.services=web:8080,admin:9000 or
+// pinge.<name>.port=8080 (pinge.<name>.host-port for a port of the host),
+// with pinge.<name>.private and pinge.<name>.custom-domain. Other pinge.*
+// labels are ignored.
+func containerServices(container DockerContainer, agentNetworks []string) ([]containerService, error) {
+	var services []containerService
+
+	labels := container.Labels
+	containerHost, hostErr := containerAddress(container, agentNetworks)
+
+	if labels["pingePort"] != "" || labels["pingeContainerPort"] != "" {
+		service := containerService{
+			Name:         labels["pingeService"],
+			CustomDomain: labels["pingeCustomDomain"],
+		}
+
+		_, service.Private = labels["pingePrivate"]
+
+		if labels["pingePort"] != "" {
+			service.Host = "localhost"
+			service.Port = labels["pingePort"]
+		} else {
+			service.Host = containerHost
+			service.Port = labels["pingeContainerPort"]
+		}
+
+		services = append(services, service)
+	}
+
+	named := make(map[string]*containerService)
+
+	get := func(name string) *containerService {
+		service, ok := named[name]
+		if !ok {
+			service = &containerService{Name: name}
+			named[name] = service
+		}
+
+		return service
+	}
+
+	if value := labels["pinge.services"]; value != "" {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+
+			i := strings.Index(item, ":")
+			if i <= 0 || i == len(item)-1 {
+				return nil, fmt.Errorf("invalid pinge.services entry %q, want name:port", item)
 			}
 
-			if err := dec.Decode(&event); err != nil {
-				if err == io.EOF {
-					// all done
-					break
-				}
+			service := get(item[:i])
+			service.Host = containerHost
+			service.Port = item[i+1:]
+		}
+	}
+
+	for key, value := range labels {
+		if !strings.HasPrefix(key, "pinge.") || key == "pinge.services" {
+			continue
+		}
+
+		// other tools may use pinge.* labels too, a label which is not
+		// pinge.<name>.<field> with a known field is skipped
+		rest := key[len("pinge."):]
+
+		i := strings.LastIndex(rest, ".")
+		if i <= 0 || !knownServiceLabels[rest[i+1:]] {
+			fmt.Println("ignore unknown label", key, "of container", container.ID)
+			continue
+		}
+
+		service := get(rest[:i])
 
-				if err != nil {
-					return
+		switch rest[i+1:] {
+		case "port":
+			service.Host = containerHost
+			service.Port = value
+		case "host-port":
+			service.Host = "localhost"
+			service.Port = value
+		case "private":
+			private := true
+
+			if value != "" {
+				var err error
+
+				if private, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid label %s: %w", key, err)
 				}
 			}
 
-			ch <- &event
+			service.Private = private
+		case "custom-domain":
+			service.CustomDomain = value
 		}
-	}()
+	}
 
-	return ch, nil
-}
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
 
-func startContainer(dockerSockPath string, token string, container DockerContainer, initHost string) error {
-	pingeService := container.Labels["pingeService"]
-	pingePort := container.Labels["pingePort"]
-	pingeContainerPort := container.Labels["pingeContainerPort"]
-	pingeCustomDomain := container.Labels["pingeCustomDomain"]
-	_, pingePrivate := container.Labels["pingePrivate"]
+	for _, name := range names {
+		service := named[name]
 
-	if pingePort == "" && pingeContainerPort == "" {
-		return nil
+		if service.Port == "" {
+			return nil, fmt.Errorf("service %s has no port label", name)
+		}
+
+		services = append(services, *service)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	for _, service := range services {
+		if _, err := strconv.Atoi(service.Port); err != nil {
+			return nil, fmt.Errorf("invalid port %q of service %s", service.Port, service.Name)
+		}
 
-	var host string
-	var port string
+		if service.Host == "" && hostErr != nil {
+			return nil, fmt.Errorf("service %s: %w", service.Name, hostErr)
+		}
+	}
 
-	if pingePort != "" {
-		host = "localhost"
-		port = pingePort
-	} else {
-		host = container.NetworkSettings.Networks.Bridge.IPAddress
-		port = pingeContainerPort
+	return services, nil
+}
+
+// containerAddress returns the address the agent reaches the container at:
+// localhost for host networking, else the ip on the network named by the
+// pingeNetwork label, on the first network shared with the agent when it
+// runs in a container, or on the first network with an ip.
+func containerAddress(container DockerContainer, agentNetworks []string) (string, error) {
+	if container.HostConfig.NetworkMode == "host" {
+		return "localhost", nil
 	}
 
-	updateEvents, err := watchContainer(ctx, dockerSockPath, container.ID)
-	if err != nil {
-		cancel()
-		return err
+	networks := container.NetworkSettings.Networks
+
+	if name := container.Labels["pingeNetwork"]; name != "" {
+		network, ok := networks[name]
+		if !ok || network.IPAddress == "" {
+			return "", fmt.Errorf("container is not on network %s", name)
+		}
+
+		return network.IPAddress, nil
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
 	}
 
-	g := errgroup.Group{}
+	sort.Strings(names)
 
-	g.Go(func() error {
-		for event := range updateEvents {
-			if event.Action == "stop" {
-				fmt.Println("stop container")
-				cancel()
-				return nil
+	if len(agentNetworks) > 0 {
+		for _, name := range names {
+			if networks[name].IPAddress != "" && contains(agentNetworks, name) {
+				return networks[name].IPAddress, nil
 			}
 		}
 
-		return nil
-	})
+		return "", fmt.Errorf("container shares no network with the agent %v", agentNetworks)
+	}
+
+	for _, name := range names {
+		if networks[name].IPAddress != "" {
+			return networks[name].IPAddress, nil
+		}
+	}
+
+	return "", fmt.Errorf("container has no network with an ip")
+}
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+var invalidServiceNameChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// containerServiceName executes the name template for the service of the
+// container.
+func containerServiceName(tmpl *template.Template, container DockerContainer, name string) (string, error) {
+	data := struct {
+		Project   string
+		Service   string
+		Container string
+		Name      string
+	}{
+		Project:   container.Labels[composeProjectLabel],
+		Service:   container.Labels[composeServiceLabel],
+		Container: container.GetName(),
+		Name:      name,
+	}
+
+	var b strings.Builder
+
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	serviceName := strings.Trim(invalidServiceNameChars.ReplaceAllString(b.String(), "-"), "-")
+	if serviceName == "" {
+		return "", fmt.Errorf("template %q gives an empty name", tmpl.Root.String())
+	}
+
+	return serviceName, nil
+}
+
+// startContainer runs the tunnels of the container services until the
+// context is done.
+func startContainer(ctx context.Context, token string, container DockerContainer, services []containerService, initHost string, baseOptions []ClientOption, urls *TunnelURLs) error {
+	limits, err := containerLimits(container.Labels)
+	if err != nil {
+		return err
+	}
 
-	g.Go(func() error {
-		fmt.Println("start service", pingeService, host, port)
-		var options []ClientOption
+	var wg sync.WaitGroup
+	errs := make(chan error, len(services))
+
+	for _, service := range services {
+		options := append([]ClientOption{}, baseOptions...)
 
 		if initHost != "" {
 			options = append(options, WithTopologyAddress(initHost))
 		}
 
-		if pingePrivate {
+		if service.Private {
 			options = append(options, WithPrivate())
 		}
 
-		if pingeCustomDomain != "" {
-			options = append(options, WithCustomDomain(pingeCustomDomain))
+		if service.CustomDomain != "" {
+			options = append(options, WithCustomDomain(service.CustomDomain))
+		}
+
+		if limits != nil {
+			options = append(options, WithLimits(*limits))
+		}
+
+		if urls != nil {
+			name := service.Name
+
+			options = append(options, WithURIHandler(func(uri string) {
+				if ctx.Err() == nil {
+					urls.set(container, name, uri)
+				}
+			}))
+		}
+
+		fmt.Println("start service", service.Name, service.Host, service.Port)
+
+		wg.Add(1)
+
+		go func(service containerService) {
+			defer wg.Done()
+
+			if err := InitService(ctx, service.Name, token, service.Host, service.Port, options); err != nil {
+				errs <- fmt.Errorf("service %s: %w", service.Name, err)
+			}
+		}(service)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// containerLimits reads the tunnel limits from the pingeMaxConnections,
+// pingeQueueTimeout, pingeConnectionsPerSecond, pingeBytesPerSecond and
+// pingeTunnelBytesPerSecond labels.
+func containerLimits(labels map[string]string) (*LimitOptions, error) {
+	var limits LimitOptions
+	var found bool
+
+	if value, ok := labels["pingeMaxConnections"]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pingeMaxConnections label: %w", err)
+		}
+
+		limits.MaxConnections = n
+		found = true
+	}
+
+	if value, ok := labels["pingeQueueTimeout"]; ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pingeQueueTimeout label: %w", err)
+		}
+
+		limits.QueueTimeout = Duration(d)
+	}
+
+	if value, ok := labels["pingeConnectionsPerSecond"]; ok {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pingeConnectionsPerSecond label: %w", err)
+		}
+
+		limits.ConnectionsPerSecond = n
+		found = true
+	}
+
+	if value, ok := labels["pingeBytesPerSecond"]; ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pingeBytesPerSecond label: %w", err)
+		}
+
+		limits.BytesPerSecond = n
+		found = true
+	}
+
+	if value, ok := labels["pingeTunnelBytesPerSecond"]; ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pingeTunnelBytesPerSecond label: %w", err)
 		}
 
-		return InitService(ctx, pingeService, token, host, port, options)
-	})
+		limits.TunnelBytesPerSecond = n
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
 
-	return g.Wait()
+	return &limits, nil
 }
 
-func getContainers(dockerSockPath string, token string, initHost string) error {
-	httpc := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial("unix", dockerSockPath)
-			},
-		},
+// dockerReconciler keeps one tunnel per running labelled container. Events
+// start and stop the tunnels as they come, and the containers are listed
+// again periodically to correct the drift after missed events.
+type dockerReconciler struct {
+	runtime        ContainerRuntime
+	token          string
+	initHost       string
+	options        []ClientOption
+	relistInterval time.Duration
+	networks       []string
+	project        string
+	nameTemplate   *template.Template
+	urls           *TunnelURLs
+	tokens         []DockerToken
+
+	mu      sync.Mutex
+	tunnels map[string]*containerTunnel
+}
+
+type containerTunnel struct {
+	services []string
+	cancel   context.CancelFunc
+	stopped  bool
+	done     chan struct{}
+}
+
+func newDockerReconciler(runtime ContainerRuntime, token string, initHost string, options []ClientOption) *dockerReconciler {
+	return &dockerReconciler{
+		runtime:        runtime,
+		token:          token,
+		initHost:       initHost,
+		options:        options,
+		relistInterval: 30 * time.Second,
+		tunnels:        make(map[string]*containerTunnel),
 	}
+}
 
-	filter := `filters={"label":["pingeService"]}`
-	res, err := httpc.Get("http://unix/v1.24/containers/json?all=1&before=8dfafdbc3a40&size=1&" + filter)
+// run reconciles the tunnels until the context is done. Only the first list
+// of containers must succeed, later errors are retried on the next relist.
+func (r *dockerReconciler) run(ctx context.Context) error {
+	containers, err := r.list(ctx)
 	if err != nil {
 		return err
 	}
 
-	defer res.Body.Close()
+	r.reconcile(ctx, containers)
+
+	events, err := r.runtime.Events(ctx)
+	if err != nil {
+		fmt.Println("cannot listen container events", err)
+	} else {
+		fmt.Println("listen containers")
+	}
+
+	ticker := time.NewTicker(r.relistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				fmt.Println("container events stopped")
+				events = nil
+				continue
+			}
+
+			r.handle(ctx, event)
+		case <-ticker.C:
+			if events == nil {
+				if events, err = r.runtime.Events(ctx); err != nil {
+					fmt.Println("cannot listen container events", err)
+				}
+			}
+
+			containers, err := r.list(ctx)
+			if err != nil {
+				fmt.Println("cannot list containers", err)
+				continue
+			}
+
+			r.reconcile(ctx, containers)
+		}
+	}
+}
 
-	if res.StatusCode != 200 {
-		return fmt.Errorf("mismatch statuses: %v", res.StatusCode)
+func (r *dockerReconciler) list(ctx context.Context) ([]DockerContainer, error) {
+	if r.project != "" {
+		return r.runtime.List(ctx, composeProjectLabel+"="+r.project)
 	}
 
-	var containers []DockerContainer
+	return r.runtime.List(ctx)
+}
 
-	if err := json.NewDecoder(res.Body).Decode(&containers); err != nil {
-		return err
+// handle stops the tunnel as soon as the container process is gone. Other
+// events are checked against the current state of the container, a kill
+// does not always stop it.
+func (r *dockerReconciler) handle(ctx context.Context, event *DockerContainerEvent) {
+	id := event.Actor.ID
+	if id == "" {
+		id = event.ID
+	}
+
+	// the events carry the labels of the container, the other containers of
+	// the host are neither logged nor inspected
+	if labels := event.Actor.Attributes; labels != nil && !hasPingeLabels(labels) {
+		return
 	}
 
-	g := errgroup.Group{}
+	switch event.Action {
+	case "die", "stop", "destroy", "pause":
+		fmt.Println("container listener receive event", event.Action, id)
+
+		r.stop(id)
+	case "start", "restart", "unpause", "kill", "oom":
+		fmt.Println("container listener receive event", event.Action, id)
+
+		container, err := r.runtime.Inspect(ctx, id)
+		if err != nil {
+			fmt.Println("cannot inspect container", id, err)
+			return
+		}
+
+		if container == nil {
+			r.stop(id)
+			return
+		}
 
-	for _, container := range containers {
 		if container.GetState() == "running" {
-			go startContainer(dockerSockPath, token, container, initHost)
+			r.start(ctx, *container)
+		} else {
+			r.stop(id)
+		}
+	}
+}
+
+// hasPingeLabels reports whether any label configures the agent.
+func hasPingeLabels(labels map[string]string) bool {
+	for key := range labels {
+		if strings.HasPrefix(key, "pinge") {
+			return true
 		}
 	}
 
-	g.Go(func() error {
-		ch, err := watchContainer(context.Background(), dockerSockPath, "")
+	return false
+}
+
+// reconcile starts the tunnels of the running containers and stops the
+// tunnels of the containers missing from the list.
+func (r *dockerReconciler) reconcile(ctx context.Context, containers []DockerContainer) {
+	running := make(map[string]bool)
+
+	for _, container := range containers {
+		if container.GetState() != "running" || !hasPingeLabels(container.Labels) {
+			continue
+		}
+
+		running[container.ID] = true
+		r.start(ctx, container)
+	}
+
+	r.mu.Lock()
+	var stale []string
+	for id, tunnel := range r.tunnels {
+		if !running[id] && !tunnel.stopped {
+			stale = append(stale, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, id := range stale {
+		r.stop(id)
+	}
+}
+
+// start runs the tunnel of the container unless it already runs. A tunnel
+// still stopping for the same container is waited for, so the gate does not
+// see the service twice.
+func (r *dockerReconciler) start(ctx context.Context, container DockerContainer) {
+	if r.project != "" && container.Labels[composeProjectLabel] != r.project {
+		return
+	}
+
+	services, err := containerServices(container, r.networks)
+	if err != nil {
+		fmt.Println("invalid labels of container", container.ID, err)
+		return
+	}
+
+	if r.nameTemplate != nil {
+		for i := range services {
+			if services[i].Name, err = containerServiceName(r.nameTemplate, container, services[i].Name); err != nil {
+				fmt.Println("cannot build service name of container", container.ID, err)
+				return
+			}
+		}
+	}
+
+	if len(services) == 0 {
+		return
+	}
+
+	// tokens are never printed, the errors name the labels only
+	token, err := r.containerToken(ctx, container)
+	if err != nil {
+		fmt.Println("cannot get token of container", container.ID, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, ok := r.tunnels[container.ID]
+	if ok && !previous.stopped {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	tunnel := &containerTunnel{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	for _, service := range services {
+		tunnel.services = append(tunnel.services, service.Name)
+	}
+
+	r.tunnels[container.ID] = tunnel
+
+	go func() {
+		defer close(tunnel.done)
+		defer cancel()
+
+		if previous != nil {
+			select {
+			case <-previous.done:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := startContainer(ctx, token, container, services, r.initHost, r.options, r.urls); err != nil && ctx.Err() == nil {
+			fmt.Println("container tunnels stopped with error", container.ID, err)
+		}
+
+		if r.urls != nil {
+			r.urls.remove(container.ID)
+		}
+
+		r.mu.Lock()
+		if r.tunnels[container.ID] == tunnel {
+			delete(r.tunnels, container.ID)
+		}
+		r.mu.Unlock()
+	}()
+}
+
+// maxTokenFileSize is the size limit of the files of the pingeTokenFile label.
+const maxTokenFileSize = 64 << 10
+
+// containerToken returns the token of the container: the content of the
+// file named by the pingeTokenFile label, which must be a regular file inside
+// a mount of the container, the value of the variable of the container named by the
+// pingeTokenEnv label, the token of the first selector matching the
+// container labels, or the agent token.
+func (r *dockerReconciler) containerToken(ctx context.Context, container DockerContainer) (string, error) {
+	if path := container.Labels["pingeTokenFile"]; path != "" {
+		hostPath, err := containerHostPath(container, path)
 		if err != nil {
-			return err
+			return "", fmt.Errorf("pingeTokenFile label: %w", err)
 		}
 
-		fmt.Println("listen containers")
+		b, err := readRegularFile(hostPath, maxTokenFileSize)
+		if os.IsNotExist(err) {
+			// the agent runs in a container without the source of the mount
+			b, err = r.runtime.ReadFile(ctx, container.ID, filepath.Clean(path), maxTokenFileSize)
+		}
 
-		for event := range ch {
-			fmt.Println("[[[[[[")
-			if event.Action == "start" {
-				fmt.Println("container listener receive event", event.Action, event.Actor.ID)
+		if err != nil {
+			return "", fmt.Errorf("pingeTokenFile label: %w", err)
+		}
 
-				res, err := httpc.Get("http://unix/v1.24/containers/" + event.Actor.ID + "/json")
-				if err != nil {
-					fmt.Println(err)
-					return err
-				}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("pingeTokenFile label: %s is empty", path)
+		}
 
-				var container DockerContainer
+		return token, nil
+	}
 
-				if err := json.NewDecoder(res.Body).Decode(&container); err != nil {
-					res.Body.Close()
-					fmt.Println(err)
-					return err
-				}
+	if name := container.Labels["pingeTokenEnv"]; name != "" {
+		env := container.Config.Env
+
+		// listed containers have no env
+		if env == nil {
+			inspected, err := r.runtime.Inspect(ctx, container.ID)
+			if err != nil {
+				return "", err
+			}
+
+			if inspected == nil {
+				return "", fmt.Errorf("container does not exist")
+			}
+
+			env = inspected.Config.Env
+		}
+
+		for _, item := range env {
+			if strings.HasPrefix(item, name+"=") && len(item) > len(name)+1 {
+				return item[len(name)+1:], nil
+			}
+		}
+
+		return "", fmt.Errorf("pingeTokenEnv label: container has no %s variable", name)
+	}
+
+	for _, token := range r.tokens {
+		if matchSelector(container.Labels, token.Selector) {
+			return token.Token, nil
+		}
+	}
+
+	return r.token, nil
+}
+
+// containerHostPath returns the path on the host of a file inside a mount
+// of the container.
+func containerHostPath(container DockerContainer, path string) (string, error) {
+	path = filepath.Clean(path)
+
+	var best *DockerMount
+
+	for i, mount := range container.Mounts {
+		destination := filepath.Clean(mount.Destination)
+
+		if path != destination && !strings.HasPrefix(path, destination+"/") {
+			continue
+		}
+
+		if best == nil || len(destination) > len(filepath.Clean(best.Destination)) {
+			best = &container.Mounts[i]
+		}
+	}
+
+	if best == nil || best.Source == "" {
+		return "", fmt.Errorf("%s is not inside a mount of the container", path)
+	}
 
-				container.Labels = container.Config.Labels
+	source := filepath.Clean(best.Source)
+	hostPath := filepath.Join(source, strings.TrimPrefix(path, filepath.Clean(best.Destination)))
 
-				go startContainer(dockerSockPath, token, container, initHost)
+	rel, err := filepath.Rel(source, hostPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not inside a mount of the container", path)
+	}
+
+	return hostPath, nil
+}
+
+// readRegularFile reads a file of at most limit bytes, refusing links and
+// anything else than a regular file.
+func readRegularFile(path string, limit int64) ([]byte, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	if info.Size() > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", path, limit)
+	}
+
+	return os.ReadFile(path)
+}
+
+// matchSelector reports whether the labels have every key=value or key of
+// the comma separated selector.
+func matchSelector(labels map[string]string, selector string) bool {
+	for _, item := range strings.Split(selector, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if i := strings.Index(item, "="); i >= 0 {
+			value, ok := labels[strings.TrimSpace(item[:i])]
+			if !ok || value != strings.TrimSpace(item[i+1:]) {
+				return false
 			}
+		} else if _, ok := labels[item]; !ok {
+			return false
 		}
+	}
+
+	return true
+}
 
-		return nil
-	})
+func (r *dockerReconciler) stop(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return g.Wait()
+	tunnel, ok := r.tunnels[id]
+	if !ok || tunnel.stopped {
+		return
+	}
+
+	fmt.Println("stop services", strings.Join(tunnel.services, ", "))
+
+	tunnel.stopped = true
+	tunnel.cancel()
+}
+
+// services returns the services of the running tunnels by container id.
+func (r *dockerReconciler) services() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	services := make(map[string][]string)
+
+	for id, tunnel := range r.tunnels {
+		if !tunnel.stopped {
+			services[id] = tunnel.services
+		}
+	}
+
+	return services
 }
 
 type DockerContainer struct {
 	ID      string      `json:"Id"`
+	Name    string      `json:"Name"`
 	Names   []string    `json:"Names"`
 	Image   string      `json:"Image"`
 	ImageID string      `json:"ImageID"`
@@ -230,33 +924,55 @@ type DockerContainer struct {
 	} `json:"HostConfig"`
 	Config struct {
 		Labels map[string]string `json:"Labels"`
+		Env    []string          `json:"Env"`
 	}
 	NetworkSettings struct {
-		Networks struct {
-			Bridge struct {
-				IPAMConfig          interface{} `json:"IPAMConfig"`
-				Links               interface{} `json:"Links"`
-				Aliases             interface{} `json:"Aliases"`
-				NetworkID           string      `json:"NetworkID"`
-				EndpointID          string      `json:"EndpointID"`
-				Gateway             string      `json:"Gateway"`
-				IPAddress           string      `json:"IPAddress"`
-				IPPrefixLen         int         `json:"IPPrefixLen"`
-				IPv6Gateway         string      `json:"IPv6Gateway"`
-				GlobalIPv6Address   string      `json:"GlobalIPv6Address"`
-				GlobalIPv6PrefixLen int         `json:"GlobalIPv6PrefixLen"`
-				MacAddress          string      `json:"MacAddress"`
-				DriverOpts          interface{} `json:"DriverOpts"`
-			} `json:"bridge"`
-		} `json:"Networks"`
+		Networks map[string]DockerNetwork `json:"Networks"`
 	} `json:"NetworkSettings"`
-	Mounts []interface{} `json:"Mounts"`
+	Mounts []DockerMount `json:"Mounts"`
+}
+
+type DockerMount struct {
+	Type        string `json:"Type"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+}
+
+type DockerNetwork struct {
+	IPAMConfig          interface{} `json:"IPAMConfig"`
+	Links               interface{} `json:"Links"`
+	Aliases             interface{} `json:"Aliases"`
+	NetworkID           string      `json:"NetworkID"`
+	EndpointID          string      `json:"EndpointID"`
+	Gateway             string      `json:"Gateway"`
+	IPAddress           string      `json:"IPAddress"`
+	IPPrefixLen         int         `json:"IPPrefixLen"`
+	IPv6Gateway         string      `json:"IPv6Gateway"`
+	GlobalIPv6Address   string      `json:"GlobalIPv6Address"`
+	GlobalIPv6PrefixLen int         `json:"GlobalIPv6PrefixLen"`
+	MacAddress          string      `json:"MacAddress"`
+	DriverOpts          interface{} `json:"DriverOpts"`
+}
+
+// GetName returns the name of a listed or inspected container.
+func (d *DockerContainer) GetName() string {
+	name := d.Name
+	if name == "" && len(d.Names) > 0 {
+		name = d.Names[0]
+	}
+
+	return strings.TrimPrefix(name, "/")
 }
 
+// GetState returns the state of a listed container, or the status of an
+// inspected one.
 func (d *DockerContainer) GetState() string {
 	switch x := d.State.(type) {
 	case string:
 		return x
+	case map[string]interface{}:
+		status, _ := x["Status"].(string)
+		return status
 	}
 
 	return ""
@@ -297,23 +1013,7 @@ type DockerContainerItem struct {
 		Labels map[string]string `json:"Labels"`
 	}
 	NetworkSettings struct {
-		Networks struct {
-			Bridge struct {
-				IPAMConfig          interface{} `json:"IPAMConfig"`
-				Links               interface{} `json:"Links"`
-				Aliases             interface{} `json:"Aliases"`
-				NetworkID           string      `json:"NetworkID"`
-				EndpointID          string      `json:"EndpointID"`
-				Gateway             string      `json:"Gateway"`
-				IPAddress           string      `json:"IPAddress"`
-				IPPrefixLen         int         `json:"IPPrefixLen"`
-				IPv6Gateway         string      `json:"IPv6Gateway"`
-				GlobalIPv6Address   string      `json:"GlobalIPv6Address"`
-				GlobalIPv6PrefixLen int         `json:"GlobalIPv6PrefixLen"`
-				MacAddress          string      `json:"MacAddress"`
-				DriverOpts          interface{} `json:"DriverOpts"`
-			} `json:"bridge"`
-		} `json:"Networks"`
+		Networks map[string]DockerNetwork `json:"Networks"`
 	} `json:"NetworkSettings"`
 	Mounts []interface{} `json:"Mounts"`
 }
@@ -0,0 +1,396 @@
+package pinge
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	dockerHostDefault = "unix:///var/run/docker.sock"
+
+	// the agent needs the api of docker 1.12, and knows nothing newer than
+	// the api of docker 20.10
+	dockerMinAPIVersion = "1.24"
+	dockerMaxAPIVersion = "1.41"
+)
+
+// dockerAPI is a client of the docker engine api.
+type dockerAPI struct {
+	httpc   *http.Client
+	baseURL string
+	version string
+	podman  bool
+}
+
+// newDockerAPI connects to the daemon at the host in DOCKER_HOST format,
+// unix:///path or tcp://host:port. Tcp connections use tls when
+// DOCKER_TLS_VERIFY or DOCKER_CERT_PATH is set, like the docker cli.
+func newDockerAPI(host string) (*dockerAPI, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+
+	if host == "" {
+		host = dockerHostDefault
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	transport := &http.Transport{}
+
+	api := dockerAPI{
+		httpc: &http.Client{
+			Transport: transport,
+		},
+		version: dockerMinAPIVersion,
+	}
+
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		if path == "" {
+			path = u.Host
+		}
+
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+
+		api.baseURL = "http://docker"
+	case "tcp", "http", "https":
+		tlsConfig, err := dockerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if tlsConfig != nil || u.Scheme == "https" {
+			transport.TLSClientConfig = tlsConfig
+			api.baseURL = "https://" + u.Host
+		} else {
+			api.baseURL = "http://" + u.Host
+		}
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+
+	return &api, nil
+}
+
+// dockerTLSConfig reads ca.pem, cert.pem and key.pem from DOCKER_CERT_PATH,
+// ~/.docker by default. The daemon certificate is verified only when
+// DOCKER_TLS_VERIFY is set.
+func dockerTLSConfig() (*tls.Config, error) {
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+
+	if !verify && certPath == "" {
+		return nil, nil
+	}
+
+	if certPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+
+		certPath = filepath.Join(home, ".docker")
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: !verify,
+	}
+
+	if verify {
+		ca, err := os.ReadFile(filepath.Join(certPath, "ca.pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", filepath.Join(certPath, "ca.pem"))
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		if verify {
+			return nil, err
+		}
+	} else {
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// negotiate picks the api version used by the requests, the version of the
+// daemon capped at dockerMaxAPIVersion.
+func (d *dockerAPI) negotiate(ctx context.Context) error {
+	version, err := d.serverVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if compareAPIVersions(version, dockerMinAPIVersion) < 0 {
+		return fmt.Errorf("docker api version %s is older than %s", version, dockerMinAPIVersion)
+	}
+
+	if compareAPIVersions(version, dockerMaxAPIVersion) > 0 {
+		version = dockerMaxAPIVersion
+	}
+
+	d.version = version
+
+	return nil
+}
+
+// serverVersion asks /_ping for the api version of the daemon, and /version
+// when the daemon is too old to answer it in a header.
+func (d *dockerAPI) serverVersion(ctx context.Context) (string, error) {
+	res, err := d.do(ctx, "/_ping", nil)
+	if err != nil {
+		return "", err
+	}
+
+	res.Body.Close()
+
+	d.podman = res.Header.Get("Libpod-API-Version") != ""
+
+	if version := res.Header.Get("API-Version"); version != "" {
+		return version, nil
+	}
+
+	res, err = d.do(ctx, "/version", nil)
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("mismatch statuses: %v", res.StatusCode)
+	}
+
+	var version struct {
+		ApiVersion string
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&version); err != nil {
+		return "", err
+	}
+
+	if version.ApiVersion == "" {
+		return "", fmt.Errorf("docker daemon does not report its api version")
+	}
+
+	return version.ApiVersion, nil
+}
+
+func (d *dockerAPI) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := d.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.httpc.Do(req)
+}
+
+// get requests the path of the negotiated api version.
+func (d *dockerAPI) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	return d.do(ctx, "/v"+d.version+path, query)
+}
+
+// List passes the labels as one filter, docker ands them. The filter matches
+// whole label keys only, so the pinge labels cannot be selected by the api:
+// the containers without them are skipped by the reconciler, and the
+// containers of the single and the multiple service labels are told apart by
+// containerServices.
+func (d *dockerAPI) List(ctx context.Context, labels ...string) ([]DockerContainer, error) {
+	query := url.Values{
+		"all": []string{"1"},
+	}
+
+	if len(labels) > 0 {
+		filters, err := json.Marshal(map[string][]string{"label": labels})
+		if err != nil {
+			return nil, err
+		}
+
+		query.Set("filters", string(filters))
+	}
+
+	res, err := d.get(ctx, "/containers/json", query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("mismatch statuses: %v", res.StatusCode)
+	}
+
+	var containers []DockerContainer
+
+	if err := json.NewDecoder(res.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	return containers, nil
+}
+
+func (d *dockerAPI) Inspect(ctx context.Context, id string) (*DockerContainer, error) {
+	res, err := d.get(ctx, "/containers/"+id+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("mismatch statuses: %v", res.StatusCode)
+	}
+
+	var container DockerContainer
+
+	if err := json.NewDecoder(res.Body).Decode(&container); err != nil {
+		return nil, err
+	}
+
+	container.Labels = container.Config.Labels
+
+	return &container, nil
+}
+
+// ReadFile reads the file through the archive api, a tar stream of the path.
+// Links are not followed.
+func (d *dockerAPI) ReadFile(ctx context.Context, id string, path string, limit int64) ([]byte, error) {
+	res, err := d.get(ctx, "/containers/"+id+"/archive", url.Values{"path": []string{path}})
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s does not exist in the container", path)
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("mismatch statuses: %v", res.StatusCode)
+	}
+
+	tr := tar.NewReader(res.Body)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read archive of %s: %w", path, err)
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	if header.Size > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", path, limit)
+	}
+
+	return io.ReadAll(io.LimitReader(tr, limit))
+}
+
+func (d *dockerAPI) Events(ctx context.Context) (<-chan *DockerContainerEvent, error) {
+	res, err := d.get(ctx, "/events", url.Values{
+		"filters": []string{`{"type":["container"]}`},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("mismatch statuses: %v", res.StatusCode)
+	}
+
+	ch := make(chan *DockerContainerEvent)
+
+	go func() {
+		defer close(ch)
+		defer res.Body.Close()
+
+		dec := json.NewDecoder(res.Body)
+
+		for {
+			var event DockerContainerEvent
+
+			if err := dec.Decode(&event); err != nil {
+				if ctx.Err() != nil {
+					fmt.Println("stop listen container events")
+				}
+
+				return
+			}
+
+			select {
+			case ch <- &event:
+			case <-ctx.Done():
+				fmt.Println("stop listen container events")
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func compareAPIVersions(a string, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
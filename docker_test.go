@@ -0,0 +1,1153 @@
+package pinge
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+// fakeDocker serves the parts of the docker engine api used by the agent on
+// a unix socket.
+type fakeDocker struct {
+	host       string
+	apiVersion string
+	podman     bool
+
+	mu          sync.Mutex
+	containers  map[string]DockerContainer
+	subscribers map[chan DockerContainerEvent][]string
+	inspects    int
+
+	// files are the contents of the files inside the containers, by id
+	// and path
+	files map[string]map[string]string
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	d := fakeDocker{
+		host:        "unix://" + filepath.Join(t.TempDir(), "docker.sock"),
+		apiVersion:  "1.41",
+		containers:  make(map[string]DockerContainer),
+		subscribers: make(map[chan DockerContainerEvent][]string),
+		files:       make(map[string]map[string]string),
+	}
+
+	l, err := net.Listen("unix", strings.TrimPrefix(d.host, "unix://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: &d}
+	go server.Serve(l)
+
+	t.Cleanup(func() { server.Close() })
+
+	return &d
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	apiVersion := d.apiVersion
+	d.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v"+apiVersion)
+
+	switch {
+	case path == "/_ping":
+		if apiVersion != "1.24" {
+			w.Header().Set("API-Version", apiVersion)
+		}
+
+		if d.podman {
+			w.Header().Set("Libpod-API-Version", "3.4.4")
+		}
+
+		w.Write([]byte("OK"))
+	case path == "/version":
+		json.NewEncoder(w).Encode(map[string]string{"ApiVersion": apiVersion})
+	case path == "/containers/json":
+		var filters map[string][]string
+		if value := r.URL.Query().Get("filters"); value != "" {
+			json.Unmarshal([]byte(value), &filters)
+		}
+
+		d.mu.Lock()
+		containers := []DockerContainer{}
+		for _, container := range d.containers {
+			if matchSelector(container.Labels, strings.Join(filters["label"], ",")) {
+				// like docker, the list has no env of the containers
+				container.Config.Env = nil
+				containers = append(containers, container)
+			}
+		}
+		d.mu.Unlock()
+
+		json.NewEncoder(w).Encode(containers)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/archive"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/archive")
+		name := r.URL.Query().Get("path")
+
+		d.mu.Lock()
+		content, ok := d.files[id][name]
+		d.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(&tar.Header{Name: filepath.Base(name), Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+		tw.Close()
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+
+		d.mu.Lock()
+		container, ok := d.containers[id]
+		d.inspects++
+		d.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		container.Config.Labels = container.Labels
+		container.Labels = nil
+		container.State = map[string]interface{}{"Status": container.State}
+
+		json.NewEncoder(w).Encode(container)
+	case path == "/events":
+		var filters map[string][]string
+		if value := r.URL.Query().Get("filters"); value != "" {
+			json.Unmarshal([]byte(value), &filters)
+		}
+
+		ch := make(chan DockerContainerEvent, 16)
+
+		d.mu.Lock()
+		d.subscribers[ch] = filters["container"]
+		d.mu.Unlock()
+
+		defer func() {
+			d.mu.Lock()
+			delete(d.subscribers, ch)
+			d.mu.Unlock()
+		}()
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case event := <-ch:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *fakeDocker) add(container DockerContainer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.containers[container.ID] = container
+}
+
+func (d *fakeDocker) addFile(id string, path string, content string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.files[id] == nil {
+		d.files[id] = make(map[string]string)
+	}
+
+	d.files[id][path] = content
+}
+
+func (d *fakeDocker) setState(id string, state string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	container := d.containers[id]
+	container.State = state
+	d.containers[id] = container
+}
+
+func (d *fakeDocker) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.containers, id)
+}
+
+func (d *fakeDocker) emit(id string, action string) {
+	var event DockerContainerEvent
+	event.Type = "container"
+	event.Action = action
+	event.Status = action
+	event.ID = id
+	event.Actor.ID = id
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// like docker, the attributes have the labels of the container
+	if container, ok := d.containers[id]; ok {
+		event.Actor.Attributes = map[string]string{"name": id}
+		for key, value := range container.Labels {
+			event.Actor.Attributes[key] = value
+		}
+	}
+
+	if d.podman {
+		event.Action = ""
+		event.Status = map[string]string{"die": "died", "destroy": "remove"}[action]
+
+		if event.Status == "" {
+			event.Status = action
+		}
+	}
+
+	for ch, containers := range d.subscribers {
+		if len(containers) == 0 || contains(containers, id) {
+			ch <- event
+		}
+	}
+}
+
+func (d *fakeDocker) inspectCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.inspects
+}
+
+func (d *fakeDocker) waitSubscribers(t *testing.T, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		d.mu.Lock()
+		count := len(d.subscribers)
+		d.mu.Unlock()
+
+		if count >= n {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d event subscribers, want %d", count, n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitFor(t *testing.T, f func() bool, format string, args ...interface{}) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for "+format, args...)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countConnects(gate *pingetest.Gate, service string) int {
+	var n int
+
+	for _, req := range gate.ConnectRequests() {
+		if req.ServiceName == service {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestDockerContainers(t *testing.T) {
+	ctx, cancel := context.WithCancel(testContext(t))
+	defer cancel()
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	docker.add(DockerContainer{
+		ID:     "web",
+		State:  "running",
+		Labels: map[string]string{"pingeService": "web", "pingePort": port},
+	})
+
+	docker.add(DockerContainer{
+		ID:     "stopped",
+		State:  "exited",
+		Labels: map[string]string{"pingeService": "stopped", "pingePort": port},
+	})
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- RunDocker(ctx, "token", topology.URL(), DockerOptions{Host: docker.host})
+	}()
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gate.Dial(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("ping"))
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("got %q, %v from web container", b, err)
+	}
+
+	conn.Close()
+
+	docker.waitSubscribers(t, 1)
+
+	docker.add(DockerContainer{
+		ID:     "api",
+		State:  "running",
+		Labels: map[string]string{"pingeService": "api", "pingePort": port, "pingePrivate": ""},
+	})
+
+	docker.emit("api", "start")
+
+	if err := gate.WaitConnected(ctx, "api", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if gate.Connected("stopped") {
+		t.Fatal("stopped container is exposed")
+	}
+
+	requests := gate.ConnectRequests()
+	if last := requests[len(requests)-1]; last.ServiceName != "api" || !last.Private {
+		t.Fatalf("unexpected connect request %+v", last)
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunDocker is still running")
+	}
+
+	if err := gate.WaitConnected(testContext(t), "api", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDockerEvents(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	docker.add(DockerContainer{
+		ID:     "web",
+		State:  "running",
+		Labels: map[string]string{"pingeService": "web", "pingePort": port},
+	})
+
+	go RunDocker(ctx, "token", topology.URL(), DockerOptions{Host: docker.host})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	docker.waitSubscribers(t, 1)
+
+	steps := []struct {
+		state     string
+		actions   []string
+		connected bool
+		connects  int
+	}{
+		{"exited", []string{"kill", "die", "stop"}, false, 1},
+		{"running", []string{"start"}, true, 2},
+		{"running", []string{"die", "start", "restart"}, true, 3},
+		{"paused", []string{"pause"}, false, 3},
+		{"running", []string{"unpause"}, true, 4},
+		{"exited", []string{"oom", "die"}, false, 4},
+		{"running", []string{"start"}, true, 5},
+	}
+
+	for _, step := range steps {
+		docker.setState("web", step.state)
+
+		for _, action := range step.actions {
+			docker.emit("web", action)
+		}
+
+		// one connect per start, the restart event must not add another one
+		waitFor(t, func() bool {
+			return countConnects(gate, "web") == step.connects && gate.Connected("web") == step.connected
+		}, "web connected %d times and connected=%v after %v", step.connects, step.connected, step.actions)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := countConnects(gate, "web"); n != 5 {
+		t.Fatalf("web connected %d times, want 5", n)
+	}
+
+	// the events of containers without pinge labels are skipped, the event
+	// of web is handled after them
+	docker.add(DockerContainer{ID: "other", State: "running", Labels: map[string]string{"team": "billing"}})
+
+	inspects := docker.inspectCount()
+
+	docker.emit("other", "start")
+	docker.emit("other", "restart")
+	docker.emit("web", "restart")
+
+	waitFor(t, func() bool { return docker.inspectCount() > inspects }, "inspect of web")
+	time.Sleep(50 * time.Millisecond)
+
+	if n := docker.inspectCount() - inspects; n != 1 {
+		t.Fatalf("got %d inspects, want only the one of web", n)
+	}
+
+	docker.remove("web")
+	docker.emit("web", "destroy")
+
+	if err := gate.WaitConnected(ctx, "web", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDockerRelist(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	api, err := newDockerAPI(docker.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.negotiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newDockerReconciler(api, "token", topology.URL(), nil)
+	r.relistInterval = 100 * time.Millisecond
+
+	go r.run(ctx)
+
+	docker.waitSubscribers(t, 1)
+
+	// no events, the containers are found by the next list
+	docker.add(DockerContainer{
+		ID:     "web",
+		State:  "running",
+		Labels: map[string]string{"pingeService": "web", "pingePort": port},
+	})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * r.relistInterval)
+
+	if n := countConnects(gate, "web"); n != 1 {
+		t.Fatalf("web connected %d times, want 1", n)
+	}
+
+	if services := r.services(); len(services) != 1 || len(services["web"]) != 1 || services["web"][0] != "web" {
+		t.Fatalf("unexpected services %v", services)
+	}
+
+	docker.remove("web")
+
+	if err := gate.WaitConnected(ctx, "web", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDockerAPIVersion(t *testing.T) {
+	ctx := testContext(t)
+	docker := newFakeDocker(t)
+
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"1.40", "1.40"},
+		{"1.43", "1.41"},
+		{"1.24", "1.24"}, // answers /_ping without the version header
+		{"1.12", ""},
+	}
+
+	for _, test := range tests {
+		docker.mu.Lock()
+		docker.apiVersion = test.server
+		docker.mu.Unlock()
+
+		api, err := newDockerAPI(docker.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = api.negotiate(ctx)
+		if test.want == "" {
+			if err == nil {
+				t.Fatalf("negotiated version %s with daemon %s", api.version, test.server)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if api.version != test.want {
+			t.Fatalf("negotiated version %s with daemon %s, want %s", api.version, test.server, test.want)
+		}
+	}
+}
+
+func TestDockerHostTCP(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.add(DockerContainer{ID: "web", State: "running"})
+
+	server := httptest.NewServer(docker)
+	defer server.Close()
+
+	api, err := newDockerAPI("tcp://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := api.negotiate(testContext(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := api.List(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(containers) != 1 || containers[0].ID != "web" {
+		t.Fatalf("unexpected containers %+v", containers)
+	}
+}
+
+func TestDockerHostTLS(t *testing.T) {
+	defer os.Setenv("DOCKER_TLS_VERIFY", os.Getenv("DOCKER_TLS_VERIFY"))
+	defer os.Setenv("DOCKER_CERT_PATH", os.Getenv("DOCKER_CERT_PATH"))
+
+	os.Setenv("DOCKER_TLS_VERIFY", "1")
+	os.Setenv("DOCKER_CERT_PATH", t.TempDir())
+
+	if _, err := newDockerAPI("tcp://127.0.0.1:2376"); err == nil {
+		t.Fatal("tls verification without ca.pem is accepted")
+	}
+
+	if _, err := newDockerAPI("ssh://user@host"); err == nil {
+		t.Fatal("unsupported docker host is accepted")
+	}
+}
+
+func TestContainerServices(t *testing.T) {
+	var container DockerContainer
+	container.NetworkSettings.Networks = map[string]DockerNetwork{"bridge": {IPAddress: "172.17.0.2"}}
+
+	tests := []struct {
+		labels map[string]string
+		want   []containerService
+		err    bool
+	}{
+		{
+			labels: map[string]string{"pingeService": "web", "pingePort": "8080", "pingePrivate": ""},
+			want:   []containerService{{Name: "web", Host: "localhost", Port: "8080", Private: true}},
+		},
+		{
+			labels: map[string]string{"pingeService": "web", "pingeContainerPort": "80", "pingeCustomDomain": "example.com"},
+			want:   []containerService{{Name: "web", Host: "172.17.0.2", Port: "80", CustomDomain: "example.com"}},
+		},
+		{
+			labels: map[string]string{
+				"pinge.services":             "web:8080, admin:9000",
+				"pinge.admin.private":        "true",
+				"pinge.web.custom-domain":    "example.com",
+				"pinge.metrics.host-port":    "9100",
+				"pinge.metrics.private":      "false",
+				"com.docker.compose.service": "app",
+				"pingeMaxConnections":        "10",
+			},
+			want: []containerService{
+				{Name: "admin", Host: "172.17.0.2", Port: "9000", Private: true},
+				{Name: "metrics", Host: "localhost", Port: "9100"},
+				{Name: "web", Host: "172.17.0.2", Port: "8080", CustomDomain: "example.com"},
+			},
+		},
+		{labels: map[string]string{"pingeService": "web"}},
+		{labels: map[string]string{"pinge.web.port": "80", "pingeNetwork": "backend"}, err: true},
+		{labels: map[string]string{"pinge.services": "web"}, err: true},
+		{labels: map[string]string{"pinge.web.private": "true"}, err: true},
+		{labels: map[string]string{"pinge.web.port": "http"}, err: true},
+		{
+			// labels of other tools and typos do not reject the valid services
+			labels: map[string]string{
+				"pinge.web":          "true",
+				"pinge.link/service": "web",
+				"pinge.":             "",
+				"pinge..port":        "80",
+				"pinge.web.prot":     "80",
+				"pinge.admin.prot":   "9000",
+				"pinge.web.port":     "8080",
+			},
+			want: []containerService{{Name: "web", Host: "172.17.0.2", Port: "8080"}},
+		},
+		{labels: map[string]string{"pinge.web.prot": "80"}},
+	}
+
+	for i, test := range tests {
+		container.Labels = test.labels
+
+		services, err := containerServices(container, nil)
+		if test.err {
+			if err == nil {
+				t.Fatalf("%d: invalid labels %v are accepted", i, test.labels)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+
+		if !reflect.DeepEqual(services, test.want) {
+			t.Fatalf("%d: got services %+v, want %+v", i, services, test.want)
+		}
+	}
+}
+
+func TestDockerMultipleServices(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	docker.add(DockerContainer{
+		ID:    "app",
+		State: "running",
+		Labels: map[string]string{
+			"pinge.web.host-port":   port,
+			"pinge.admin.host-port": port,
+			"pinge.admin.private":   "",
+		},
+	})
+
+	go RunDocker(ctx, "token", topology.URL(), DockerOptions{Host: docker.host})
+
+	for _, service := range []string{"web", "admin"} {
+		if err := gate.WaitConnected(ctx, service, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, req := range gate.ConnectRequests() {
+		if req.Private != (req.ServiceName == "admin") {
+			t.Fatalf("unexpected connect request %+v", req)
+		}
+	}
+
+	docker.waitSubscribers(t, 1)
+	docker.setState("app", "exited")
+	docker.emit("app", "die")
+
+	for _, service := range []string{"web", "admin"} {
+		if err := gate.WaitConnected(ctx, service, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContainerAddress(t *testing.T) {
+	networks := map[string]DockerNetwork{
+		"bridge":          {},
+		"project_default": {IPAddress: "172.18.0.2"},
+		"project_backend": {IPAddress: "172.19.0.2"},
+	}
+
+	tests := []struct {
+		mode   string
+		label  string
+		agent  []string
+		want   string
+		hasErr bool
+	}{
+		{want: "172.19.0.2"},
+		{mode: "host", want: "localhost"},
+		{label: "project_default", want: "172.18.0.2"},
+		{label: "bridge", hasErr: true},
+		{agent: []string{"bridge", "project_default"}, want: "172.18.0.2"},
+		{agent: []string{"other"}, hasErr: true},
+		{label: "project_default", agent: []string{"other"}, want: "172.18.0.2"},
+	}
+
+	for i, test := range tests {
+		var container DockerContainer
+		container.HostConfig.NetworkMode = test.mode
+		container.NetworkSettings.Networks = networks
+		container.Labels = map[string]string{}
+
+		if test.label != "" {
+			container.Labels["pingeNetwork"] = test.label
+		}
+
+		address, err := containerAddress(container, test.agent)
+		if test.hasErr {
+			if err == nil {
+				t.Fatalf("%d: got address %s, want error", i, address)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+
+		if address != test.want {
+			t.Fatalf("%d: got address %s, want %s", i, address, test.want)
+		}
+	}
+}
+
+func TestContainerServiceName(t *testing.T) {
+	container := DockerContainer{
+		Names: []string{"/shop_web_1"},
+		Labels: map[string]string{
+			"com.docker.compose.project": "shop",
+			"com.docker.compose.service": "web_app",
+		},
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{{.Project}}-{{.Service}}", "shop-web-app"},
+		{"{{.Container}}", "shop-web-1"},
+		{"{{.Project}}-{{.Name}}", "shop-admin"},
+		{"{{.Missing}}", ""},
+		{"__", ""},
+	}
+
+	for _, test := range tests {
+		tmpl, err := template.New("name").Option("missingkey=error").Parse(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name, err := containerServiceName(tmpl, container, "admin")
+		if test.want == "" {
+			if err == nil {
+				t.Fatalf("template %s gives name %s, want error", test.template, name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name != test.want {
+			t.Fatalf("template %s gives name %s, want %s", test.template, name, test.want)
+		}
+	}
+}
+
+func TestDockerProject(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	for _, project := range []string{"shop", "blog"} {
+		docker.add(DockerContainer{
+			ID:    project,
+			State: "running",
+			Labels: map[string]string{
+				"pingeService":               "web",
+				"pingePort":                  port,
+				"com.docker.compose.project": project,
+			},
+		})
+	}
+
+	go RunDocker(ctx, "token", topology.URL(), DockerOptions{
+		Host:         docker.host,
+		Project:      "shop",
+		NameTemplate: "{{.Project}}-{{.Name}}",
+	})
+
+	if err := gate.WaitConnected(ctx, "shop-web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	docker.waitSubscribers(t, 1)
+	docker.emit("blog", "start")
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, req := range gate.ConnectRequests() {
+		if req.ServiceName != "shop-web" {
+			t.Fatalf("service %s of another project is exposed", req.ServiceName)
+		}
+	}
+}
+
+func TestPodmanRuntime(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+	docker.podman = true
+
+	runtime, err := NewContainerRuntime(ctx, "", docker.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := runtime.(*podmanRuntime); !ok {
+		t.Fatalf("got runtime %T, want podman", runtime)
+	}
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	docker.add(DockerContainer{
+		ID:     "web",
+		State:  "running",
+		Labels: map[string]string{"pingeService": "web", "pingePort": port},
+	})
+
+	go RunDocker(ctx, "token", topology.URL(), DockerOptions{Host: docker.host})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	docker.waitSubscribers(t, 1)
+
+	docker.setState("web", "exited")
+	docker.emit("web", "die")
+
+	if err := gate.WaitConnected(ctx, "web", false); err != nil {
+		t.Fatal(err)
+	}
+
+	docker.setState("web", "running")
+	docker.emit("web", "start")
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	docker.remove("web")
+	docker.emit("web", "destroy")
+
+	if err := gate.WaitConnected(ctx, "web", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectRuntimeSocket(t *testing.T) {
+	docker := newFakeDocker(t)
+	dir := t.TempDir()
+
+	socket := detectRuntimeSocket([]string{
+		filepath.Join(dir, "docker.sock"),
+		strings.TrimPrefix(docker.host, "unix://"),
+	})
+
+	if socket != docker.host {
+		t.Fatalf("detected socket %s, want %s", socket, docker.host)
+	}
+
+	if socket := detectRuntimeSocket([]string{filepath.Join(dir, "docker.sock")}); socket != dockerHostDefault {
+		t.Fatalf("detected socket %s without sockets, want %s", socket, dockerHostDefault)
+	}
+
+	if _, err := NewContainerRuntime(testContext(t), "containerd", docker.host); err == nil {
+		t.Fatal("unknown runtime is accepted")
+	}
+}
+
+func TestDockerURLs(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	container := DockerContainer{
+		ID:     "0123456789abcdef",
+		Names:  []string{"/shop_web_1"},
+		State:  "running",
+		Labels: map[string]string{"pinge.web.host-port": port, "pinge.admin.host-port": port},
+	}
+	container.NetworkSettings.Networks = map[string]DockerNetwork{"shop_default": {IPAddress: "127.0.0.1"}}
+
+	docker.add(container)
+
+	statePath := filepath.Join(t.TempDir(), "urls.json")
+	urls := NewTunnelURLs(statePath)
+
+	go RunDocker(ctx, "token", topology.URL(), DockerOptions{Host: docker.host, URLs: urls})
+
+	want := map[string]ContainerURLs{
+		container.ID: {
+			Name: "shop_web_1",
+			IPs:  []string{"127.0.0.1"},
+			Services: map[string]string{
+				"web":   "https://" + gate.URI("web"),
+				"admin": "https://" + gate.URI("admin"),
+			},
+		},
+	}
+
+	waitFor(t, func() bool {
+		b, err := os.ReadFile(statePath)
+		if err != nil {
+			return false
+		}
+
+		var state map[string]ContainerURLs
+		json.Unmarshal(b, &state)
+
+		return reflect.DeepEqual(state, want)
+	}, "state file with %v", want)
+
+	server := httptest.NewServer(urls)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer res.Body.Close()
+
+		b, _ := io.ReadAll(res.Body)
+
+		return res.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	for _, path := range []string{"/shop_web_1/web", "/0123456789ab/web", "/self/web"} {
+		if code, body := get(path); code != 200 || body != "https://"+gate.URI("web") {
+			t.Fatalf("%s: got %d %s", path, code, body)
+		}
+	}
+
+	if code, _ := get("/other/web"); code != 404 {
+		t.Fatalf("unknown container: got %d, want 404", code)
+	}
+
+	if code, _ := get("/shop_web_1/other"); code != 404 {
+		t.Fatalf("unknown service: got %d, want 404", code)
+	}
+
+	docker.waitSubscribers(t, 1)
+	docker.setState(container.ID, "exited")
+	docker.emit(container.ID, "die")
+
+	waitFor(t, func() bool {
+		b, err := os.ReadFile(statePath)
+		return err == nil && strings.TrimSpace(string(b)) == "{}"
+	}, "empty state file")
+}
+
+func TestDockerTokens(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t, pingetest.WithTokens("file-token", "archive-token", "env-token", "team-token", "agent-token"))
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	docker := newFakeDocker(t)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+
+	secrets := t.TempDir()
+	if err := os.WriteFile(filepath.Join(secrets, "pinge"), []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(secrets, "pinge"), filepath.Join(secrets, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	file := DockerContainer{
+		ID:     "file",
+		State:  "running",
+		Labels: map[string]string{"pinge.file.host-port": port, "pingeTokenFile": "/run/secrets/pinge"},
+		Mounts: []DockerMount{{Type: "bind", Source: secrets, Destination: "/run/secrets"}},
+	}
+
+	env := DockerContainer{
+		ID:     "env",
+		State:  "running",
+		Labels: map[string]string{"pinge.env.host-port": port, "pingeTokenEnv": "PINGE_TOKEN"},
+	}
+	env.Config.Env = []string{"PATH=/bin", "PINGE_TOKEN=env-token"}
+
+	escape := DockerContainer{
+		ID:     "escape",
+		State:  "running",
+		Labels: map[string]string{"pinge.escape.host-port": port, "pingeTokenFile": "/run/secrets/../../etc/hostname"},
+		Mounts: []DockerMount{{Type: "bind", Source: secrets, Destination: "/run/secrets"}},
+	}
+
+	// the agent runs in a container without the source of the mount, the
+	// file is read from the container
+	archive := DockerContainer{
+		ID:     "archive",
+		State:  "running",
+		Labels: map[string]string{"pinge.archive.host-port": port, "pingeTokenFile": "/run/secrets/pinge"},
+		Mounts: []DockerMount{{Type: "bind", Source: filepath.Join(secrets, "missing"), Destination: "/run/secrets"}},
+	}
+
+	link := DockerContainer{
+		ID:     "link",
+		State:  "running",
+		Labels: map[string]string{"pinge.link.host-port": port, "pingeTokenFile": "/run/secrets/link"},
+		Mounts: []DockerMount{{Type: "bind", Source: secrets, Destination: "/run/secrets"}},
+	}
+
+	docker.add(file)
+	docker.add(archive)
+	docker.addFile("archive", "/run/secrets/pinge", "archive-token\n")
+	docker.add(env)
+	docker.add(escape)
+	docker.add(link)
+	docker.add(DockerContainer{
+		ID:     "team",
+		State:  "running",
+		Labels: map[string]string{"pinge.team.host-port": port, "team": "payments"},
+	})
+	docker.add(DockerContainer{
+		ID:     "agent",
+		State:  "running",
+		Labels: map[string]string{"pinge.agent.host-port": port, "team": "billing"},
+	})
+
+	go RunDocker(ctx, "agent-token", topology.URL(), DockerOptions{
+		Host: docker.host,
+		Tokens: []DockerToken{
+			{Selector: "team=payments", Token: "team-token"},
+			{Selector: "other", Token: "other-token"},
+		},
+	})
+
+	for _, service := range []string{"file", "archive", "env", "team", "agent"} {
+		if err := gate.WaitConnected(ctx, service, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, req := range gate.ConnectRequests() {
+		if req.Token != req.ServiceName+"-token" {
+			t.Fatalf("service %s connected with another token", req.ServiceName)
+		}
+	}
+
+	if gate.Connected("escape") {
+		t.Fatal("token file outside of the container mounts is read")
+	}
+
+	if gate.Connected("link") {
+		t.Fatal("token file behind a link is read")
+	}
+}
+
+func TestContainerHostPath(t *testing.T) {
+	container := DockerContainer{
+		Mounts: []DockerMount{
+			{Source: "/var/lib/app", Destination: "/app"},
+			{Source: "/srv/secrets", Destination: "/app/secrets/"},
+		},
+	}
+
+	tests := map[string]string{
+		"/app/config":            "/var/lib/app/config",
+		"/app/secrets/token":     "/srv/secrets/token",
+		"/app/secrets/../config": "/var/lib/app/config",
+		"/app/../etc/passwd":     "",
+		"/application/token":     "",
+	}
+
+	for path, want := range tests {
+		got, err := containerHostPath(container, path)
+		if want == "" {
+			if err == nil {
+				t.Fatalf("%s: got %s, want error", path, got)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		if got != want {
+			t.Fatalf("%s: got %s, want %s", path, got, want)
+		}
+	}
+}
@@ -3,7 +3,7 @@ module github.com/pinge-link/sdk
 go 1.16
 
 require (
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	google.golang.org/grpc v1.42.0
 	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,192 @@
+package pinge
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func NewHAR(captures []*Capture) *HAR {
+	har := HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{
+				Name:    "pinge-agent",
+				Version: "1.0",
+			},
+			Entries: []HAREntry{},
+		},
+	}
+
+	captures = append([]*Capture{}, captures...)
+	sort.Slice(captures, func(i, j int) bool {
+		return captures[i].StartedAt.Before(captures[j].StartedAt)
+	})
+
+	for _, capture := range captures {
+		har.Log.Entries = append(har.Log.Entries, newHAREntry(capture))
+	}
+
+	return &har
+}
+
+func newHAREntry(capture *Capture) HAREntry {
+	ms := float64(capture.Duration) / float64(time.Millisecond)
+
+	entry := HAREntry{
+		StartedDateTime: capture.StartedAt.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: HARRequest{
+			Method:      capture.Request.Method,
+			URL:         capture.Request.URL,
+			HTTPVersion: capture.Request.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(capture.Request.Header),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(capture.Request.Body),
+		},
+		Timings: HARTimings{
+			Wait: ms,
+		},
+		Comment: capture.Error,
+	}
+
+	if u, err := url.Parse(capture.Request.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{Name: name, Value: value})
+			}
+		}
+	}
+
+	if len(capture.Request.Body) > 0 {
+		text, encoding := bodyText(capture.Request.Body)
+
+		entry.Request.PostData = &HARPostData{
+			MimeType: mimeType(capture.Request.Header),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+
+	if capture.Response != nil {
+		text, encoding := bodyText(capture.Response.Body)
+
+		entry.Response = HARResponse{
+			Status:      capture.Response.StatusCode,
+			StatusText:  http.StatusText(capture.Response.StatusCode),
+			HTTPVersion: capture.Request.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(capture.Response.Header),
+			Content: HARContent{
+				Size:     len(capture.Response.Body),
+				MimeType: mimeType(capture.Response.Header),
+				Text:     text,
+				Encoding: encoding,
+			},
+			HeadersSize: -1,
+			BodySize:    len(capture.Response.Body),
+		}
+	} else {
+		entry.Response = HARResponse{
+			Cookies:     []HARNameValue{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+
+	return entry
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+
+	return headers
+}
@@ -0,0 +1,120 @@
+package pinge
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// HTTPOptions switch the local side of a tunnel from a raw tcp pipe to an
+// http reverse proxy.
+type HTTPOptions struct {
+	RewriteHost bool `json:"rewrite_host,omitempty"`
+
+	// ForwardedHeaders sets X-Forwarded-Proto, X-Forwarded-Host and
+	// Forwarded with host and proto. The gate sends no visitor address, so
+	// there is no X-Forwarded-For or Forwarded for=: the values sent by the
+	// visitor are removed in any case, they could be spoofed.
+	ForwardedHeaders      bool              `json:"forwarded_headers,omitempty"`
+	RequestHeaders        map[string]string `json:"request_headers,omitempty"`
+	RemoveRequestHeaders  []string          `json:"remove_request_headers,omitempty"`
+	ResponseHeaders       map[string]string `json:"response_headers,omitempty"`
+	RemoveResponseHeaders []string          `json:"remove_response_headers,omitempty"`
+}
+
+func newHTTPProxy(b *balancer, options HTTPOptions) *httputil.ReverseProxy {
+	target := &url.URL{
+		Scheme: "http",
+		Host:   b.backends[0].target.Host(),
+	}
+
+	// every request dials through the balancer, a keep-alive pool would
+	// bypass the strategy and the health checks
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DisableKeepAlives = true
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return b.dial(ctx)
+	}
+
+	director := func(req *http.Request) {
+		publicHost := req.Host
+
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+
+		// the remote address is the gate and the gate does not tell the
+		// visitor address, a nil value stops the proxy from adding it and
+		// drops the value sent by the visitor
+		req.Header["X-Forwarded-For"] = nil
+		req.Header.Del("Forwarded")
+
+		if options.RewriteHost {
+			req.Host = target.Host
+		}
+
+		if options.ForwardedHeaders {
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", publicHost)
+			req.Header.Set("Forwarded", "host="+quoteForwarded(publicHost)+";proto=https")
+		}
+
+		for _, name := range options.RemoveRequestHeaders {
+			req.Header.Del(name)
+		}
+
+		for name, value := range options.RequestHeaders {
+			req.Header.Set(name, value)
+		}
+	}
+
+	modifyResponse := func(res *http.Response) error {
+		for _, name := range options.RemoveResponseHeaders {
+			res.Header.Del(name)
+		}
+
+		for name, value := range options.ResponseHeaders {
+			res.Header.Set(name, value)
+		}
+
+		return nil
+	}
+
+	return &httputil.ReverseProxy{
+		Director:       director,
+		ModifyResponse: modifyResponse,
+		Transport:      transport,
+		// flush immediately, so that streaming bodies are not buffered
+		FlushInterval: -1,
+	}
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+
+	return value
+}
+
+func serveHTTP(ctx context.Context, client *Client, handler http.Handler) error {
+	server := &http.Server{
+		Handler:     handler,
+		IdleTimeout: client.idleTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.Serve(client)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
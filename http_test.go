@@ -0,0 +1,126 @@
+package pinge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+// newHeaderServer starts an http backend answering with the host and the
+// headers of the request as json.
+func newHeaderServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Backend", "1")
+
+		r.Header.Set("Host", r.Host)
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  HTTPOptions
+		request  map[string]string
+		want     map[string]string
+		response map[string]string
+	}{
+		{
+			// the visitor cannot make up its address
+			name:    "plain",
+			request: map[string]string{"X-Forwarded-For": "10.0.0.1", "Forwarded": "for=10.0.0.1"},
+			want: map[string]string{
+				"Host":              "plain.pinge.test",
+				"X-Forwarded-For":   "",
+				"X-Forwarded-Proto": "",
+				"Forwarded":         "",
+			},
+			response: map[string]string{"Server": "backend", "X-Backend": "1"},
+		},
+		{
+			name:    "forwarded",
+			options: HTTPOptions{ForwardedHeaders: true},
+			request: map[string]string{"X-Forwarded-For": "10.0.0.1", "Forwarded": "for=10.0.0.1"},
+			want: map[string]string{
+				"X-Forwarded-For":   "",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "forwarded.pinge.test",
+				"Forwarded":         "host=forwarded.pinge.test;proto=https",
+			},
+		},
+		{
+			name: "headers",
+			options: HTTPOptions{
+				RewriteHost:           true,
+				RequestHeaders:        map[string]string{"X-Api-Key": "secret"},
+				RemoveRequestHeaders:  []string{"Cookie"},
+				ResponseHeaders:       map[string]string{"X-Frame-Options": "DENY"},
+				RemoveResponseHeaders: []string{"Server"},
+			},
+			request: map[string]string{"Cookie": "session=1", "X-Api-Key": "visitor"},
+			want: map[string]string{
+				"X-Api-Key": "secret",
+				"Cookie":    "",
+			},
+			response: map[string]string{"Server": "", "X-Backend": "1", "X-Frame-Options": "DENY"},
+		},
+	}
+
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	backend := newHeaderServer(t)
+
+	for _, test := range tests {
+		go InitServiceTarget(ctx, test.name, "token", backend.Listener.Addr().String(), []ClientOption{
+			WithTopologyAddress(topology.URL()),
+			WithHTTP(test.options),
+		})
+
+		if err := gate.WaitConnected(ctx, test.name, true); err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", "http://"+gate.URI(test.name)+"/", nil)
+		for name, value := range test.request {
+			req.Header.Set(name, value)
+		}
+
+		res, err := gate.HTTPClient(test.name).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got http.Header
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.options.RewriteHost && got.Get("Host") != backend.Listener.Addr().String() {
+			t.Errorf("%s: backend got host %q, want the backend address", test.name, got.Get("Host"))
+		}
+
+		for name, value := range test.want {
+			if got.Get(name) != value {
+				t.Errorf("%s: backend got %s %q, want %q", test.name, name, got.Get(name), value)
+			}
+		}
+
+		for name, value := range test.response {
+			if res.Header.Get(name) != value {
+				t.Errorf("%s: visitor got %s %q, want %q", test.name, name, res.Header.Get(name), value)
+			}
+		}
+	}
+}
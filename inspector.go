@@ -0,0 +1,354 @@
+package pinge
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const redactedValue = "[REDACTED]"
+
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+type InspectorOptions struct {
+	Capacity    int   `json:"capacity,omitempty"`
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// RedactHeaders hides the values of more headers, Authorization,
+	// Proxy-Authorization, Cookie and Set-Cookie are always hidden.
+	RedactHeaders []string `json:"redact_headers,omitempty"`
+	// Dir keeps the captures on disk, so that they survive restarts.
+	Dir string `json:"dir,omitempty"`
+}
+
+// Inspector records the http traffic of the tunnels in a bounded ring, so
+// that it can be browsed from the admin api.
+type Inspector struct {
+	options InspectorOptions
+
+	mu       sync.RWMutex
+	entries  []*Capture
+	next     int
+	lastID   uint64
+	handlers map[string]*replayHandler
+}
+
+type Capture struct {
+	ID        string            `json:"id"`
+	Service   string            `json:"service"`
+	Target    string            `json:"target"`
+	StartedAt time.Time         `json:"started_at"`
+	Duration  time.Duration     `json:"duration"`
+	Request   CapturedRequest   `json:"request"`
+	Response  *CapturedResponse `json:"response,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Replays   []*Replay         `json:"replays,omitempty"`
+
+	// redactedHeader keeps the values of the redacted request headers for
+	// replays, it is neither shown nor saved.
+	redactedHeader http.Header
+	version        uint64
+	file           *captureFile
+}
+
+type CapturedRequest struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Proto         string      `json:"proto"`
+	RemoteAddr    string      `json:"remote_addr"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+type CapturedResponse struct {
+	StatusCode    int         `json:"status_code"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+func NewInspector(options InspectorOptions) (*Inspector, error) {
+	if options.Capacity <= 0 {
+		options.Capacity = 100
+	}
+
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = 64 << 10
+	}
+
+	redact := make(map[string]bool)
+	names := append(append([]string{}, defaultRedactHeaders...), options.RedactHeaders...)
+	options.RedactHeaders = nil
+
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+
+		if !redact[name] {
+			redact[name] = true
+			options.RedactHeaders = append(options.RedactHeaders, name)
+		}
+	}
+
+	i := Inspector{
+		options:  options,
+		entries:  make([]*Capture, options.Capacity),
+		handlers: make(map[string]*replayHandler),
+	}
+
+	if options.Dir != "" {
+		if err := i.load(); err != nil {
+			return nil, fmt.Errorf("cannot load captures: %w", err)
+		}
+	}
+
+	return &i, nil
+}
+
+func WithInspector(inspector *Inspector) ClientOption {
+	return func(c *Client) {
+		c.inspector = inspector
+	}
+}
+
+// Middleware records every request passing to next. Bodies are captured
+// while they stream through, up to MaxBodySize.
+func (i *Inspector) Middleware(service string, target string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capture := &Capture{
+			Service:   service,
+			Target:    target,
+			StartedAt: time.Now(),
+			Request: CapturedRequest{
+				Method:     r.Method,
+				URL:        "https://" + r.Host + r.URL.RequestURI(),
+				Proto:      r.Proto,
+				RemoteAddr: r.RemoteAddr,
+				Header:     i.redact(r.Header),
+			},
+			redactedHeader: i.redactedHeader(r.Header),
+		}
+
+		reqBody := &limitedBuffer{limit: i.options.MaxBodySize}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeReadCloser{ReadCloser: r.Body, w: reqBody}
+		}
+
+		cw := &captureWriter{
+			ResponseWriter: w,
+			body:           &limitedBuffer{limit: i.options.MaxBodySize},
+		}
+
+		next.ServeHTTP(cw, r)
+
+		capture.Duration = time.Since(capture.StartedAt)
+		capture.Request.Body = reqBody.buf
+		capture.Request.BodyTruncated = reqBody.truncated
+
+		if cw.status == 0 && !cw.hijacked {
+			cw.status = http.StatusOK
+		}
+
+		if cw.hijacked {
+			capture.Error = "connection upgraded"
+		}
+
+		capture.Response = &CapturedResponse{
+			StatusCode:    cw.status,
+			Header:        i.redact(cw.Header()),
+			Body:          cw.body.buf,
+			BodyTruncated: cw.body.truncated,
+		}
+
+		i.add(capture)
+	})
+}
+
+func (i *Inspector) add(capture *Capture) {
+	i.mu.Lock()
+
+	i.lastID++
+	capture.ID = strconv.FormatUint(i.lastID, 10)
+	capture.file = &captureFile{}
+
+	old := i.entries[i.next]
+
+	i.entries[i.next] = capture
+	i.next = (i.next + 1) % len(i.entries)
+
+	save := i.encodeFile(capture)
+
+	i.mu.Unlock()
+
+	if old != nil {
+		i.removeFile(old)
+	}
+
+	save()
+}
+
+// Entries returns the recorded captures, newest first.
+func (i *Inspector) Entries() []*Capture {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries := make([]*Capture, 0, len(i.entries))
+
+	for n := 1; n <= len(i.entries); n++ {
+		entry := i.entries[(i.next-n+len(i.entries))%len(i.entries)]
+		if entry == nil {
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func (i *Inspector) Entry(id string) (*Capture, bool) {
+	for _, entry := range i.Entries() {
+		if entry.ID == id {
+			i.mu.RLock()
+			defer i.mu.RUnlock()
+
+			copied := *entry
+			copied.Replays = append([]*Replay{}, entry.Replays...)
+
+			return &copied, true
+		}
+	}
+
+	return nil, false
+}
+
+func (i *Inspector) redact(header http.Header) http.Header {
+	header = header.Clone()
+
+	for _, name := range i.options.RedactHeaders {
+		name = http.CanonicalHeaderKey(name)
+
+		for n := range header[name] {
+			header[name][n] = redactedValue
+		}
+	}
+
+	return header
+}
+
+// redactedHeader returns the original values of the headers hidden by
+// redact.
+func (i *Inspector) redactedHeader(header http.Header) http.Header {
+	redacted := make(http.Header)
+
+	for _, name := range i.options.RedactHeaders {
+		name = http.CanonicalHeaderKey(name)
+
+		if values, ok := header[name]; ok {
+			redacted[name] = append([]string{}, values...)
+		}
+	}
+
+	return redacted
+}
+
+type limitedBuffer struct {
+	buf       []byte
+	limit     int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	free := b.limit - int64(len(b.buf))
+
+	if int64(len(p)) > free {
+		b.buf = append(b.buf, p[:free]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+
+	return len(p), nil
+}
+
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+
+	return n, err
+}
+
+// captureWriter keeps Flusher and Hijacker of the underlying writer, so that
+// streaming and websocket upgrades keep working while being inspected.
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	body     *limitedBuffer
+	hijacked bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	w.body.Write(p)
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	w.hijacked = true
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+func bodyText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func mimeType(header http.Header) string {
+	return strings.TrimSpace(header.Get("Content-Type"))
+}
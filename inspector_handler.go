@@ -0,0 +1,204 @@
+package pinge
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type CaptureSummary struct {
+	ID        string        `json:"id"`
+	Service   string        `json:"service"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Method    string        `json:"method"`
+	URL       string        `json:"url"`
+	Status    int           `json:"status"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Handler serves the inspector ui and json api, it is mounted under
+// /inspect/ by the admin api.
+func (i *Inspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/inspect/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/inspect/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(inspectorPage))
+	})
+
+	mux.HandleFunc("/inspect/api/requests", func(w http.ResponseWriter, r *http.Request) {
+		summaries := []CaptureSummary{}
+
+		for _, entry := range i.Entries() {
+			summary := CaptureSummary{
+				ID:        entry.ID,
+				Service:   entry.Service,
+				StartedAt: entry.StartedAt,
+				Duration:  entry.Duration,
+				Method:    entry.Request.Method,
+				URL:       entry.Request.URL,
+				Error:     entry.Error,
+			}
+
+			if entry.Response != nil {
+				summary.Status = entry.Response.StatusCode
+			}
+
+			summaries = append(summaries, summary)
+		}
+
+		writeJSON(w, summaries)
+	})
+
+	mux.HandleFunc("/inspect/api/requests/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/inspect/api/requests/")
+
+		if strings.HasSuffix(id, "/replay") {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			// the replay sends the hidden credentials again: a page of
+			// another site must not trigger it, its forms cannot post json
+			// and its scripts send their origin
+			if !sameOrigin(r) {
+				http.Error(w, "cross origin replay", http.StatusForbidden)
+				return
+			}
+
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				http.Error(w, "replay wants application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			var edit ReplayEdit
+
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			replay, err := i.Replay(strings.TrimSuffix(id, "/replay"), edit)
+			if err == ErrorCaptureNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			writeJSON(w, replay)
+			return
+		}
+
+		entry, ok := i.Entry(id)
+		if !ok {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, entry)
+	})
+
+	mux.HandleFunc("/inspect/api/har", func(w http.ResponseWriter, r *http.Request) {
+		entries := i.Entries()
+
+		if id := r.URL.Query().Get("id"); id != "" {
+			entry, ok := i.Entry(id)
+			if !ok {
+				http.Error(w, "capture not found", http.StatusNotFound)
+				return
+			}
+
+			entries = []*Capture{entry}
+		}
+
+		w.Header().Set("Content-Disposition", `attachment; filename="pinge.har"`)
+		writeJSON(w, NewHAR(entries))
+	})
+
+	return mux
+}
+
+// sameOrigin reports whether the request comes from the admin api itself or
+// from a client which is not a browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+
+	return err == nil && u.Host == r.Host
+}
+
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pinge inspector</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 45%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow: auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+td, th { padding: 4px 6px; text-align: left; border-bottom: 1px solid #eee; }
+tr.entry { cursor: pointer; }
+tr.entry:hover { background: #f4f4f4; }
+pre { background: #f8f8f8; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<div id="list">
+<p>&nbsp;<a href="api/har">export HAR</a> &middot; <a href="#" onclick="load(); return false">refresh</a></p>
+<table><thead><tr><th>service</th><th>method</th><th>url</th><th>status</th><th>ms</th></tr></thead><tbody id="entries"></tbody></table>
+</div>
+<div id="detail"><p>select a request</p></div>
+<script>
+function text(s) { var d = document.createElement('div'); d.textContent = s; return d.innerHTML; }
+function headers(h) { var out = ''; for (var k in h) { h[k].forEach(function (v) { out += k + ': ' + v + '\n'; }); } return out; }
+function body(b) { if (!b) return ''; try { return atob(b); } catch (e) { return b; } }
+function load() {
+  fetch('api/requests').then(function (r) { return r.json(); }).then(function (entries) {
+    document.getElementById('entries').innerHTML = entries.map(function (e) {
+      return '<tr class="entry" onclick="show(\'' + e.id + '\')"><td>' + text(e.service) + '</td><td>' + text(e.method) +
+        '</td><td>' + text(e.url) + '</td><td>' + (e.status || '') + '</td><td>' + Math.round(e.duration / 1e6) + '</td></tr>';
+    }).join('');
+  });
+}
+function show(id) {
+  fetch('api/requests/' + id).then(function (r) { return r.json(); }).then(function (e) {
+    var res = e.response || {};
+    document.getElementById('detail').innerHTML =
+      '<h3>' + text(e.request.method + ' ' + e.request.url) + '</h3>' +
+      '<p><a href="api/har?id=' + e.id + '">export HAR</a> &middot; <a href="#" onclick="replay(\'' + e.id + '\'); return false">replay</a></p>' +
+      '<h4>request</h4><pre>' + text(headers(e.request.header)) + '</pre><pre>' + text(body(e.request.body)) + '</pre>' +
+      '<h4>response ' + (res.status_code || '') + '</h4><pre>' + text(headers(res.header || {})) + '</pre><pre>' + text(body(res.body)) + '</pre>' +
+      (e.replays || []).map(function (p, n) {
+        var pr = p.response || {};
+        return '<h4>replay ' + (n + 1) + ' ' + (pr.status_code || text(p.error || '')) + '</h4><pre>' + text(headers(pr.header || {})) + '</pre><pre>' + text(body(pr.body)) + '</pre>';
+      }).join('');
+  });
+}
+function replay(id) {
+  fetch('api/requests/' + id + '/replay', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: '{}' }).then(function () { show(id); });
+}
+load();
+setInterval(load, 3000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,193 @@
+package pinge
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+// newInspectedService exposes the http backend through the gate, recorded
+// by a new inspector.
+func newInspectedService(t *testing.T, gate *pingetest.Gate, service string, backend http.Handler, options InspectorOptions, clientOptions ...ClientOption) *Inspector {
+	ctx := testContext(t)
+
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+
+	inspector, err := NewInspector(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientOptions = append([]ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithHTTP(HTTPOptions{}),
+		WithInspector(inspector),
+	}, clientOptions...)
+
+	go InitServiceTarget(ctx, service, "token", server.Listener.Addr().String(), clientOptions)
+
+	if err := gate.WaitConnected(ctx, service, true); err != nil {
+		t.Fatal(err)
+	}
+
+	return inspector
+}
+
+// echoBodyHandler answers with the request body, or binary data at /binary.
+func echoBodyHandler(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+
+	if r.URL.Path == "/binary" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte{0xff, 0xfe, 0x00})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Set-Cookie", "session=secret")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func TestInspector(t *testing.T) {
+	gate := newTestGate(t)
+	inspector := newInspectedService(t, gate, "web", http.HandlerFunc(echoBodyHandler), InspectorOptions{
+		Capacity:      2,
+		MaxBodySize:   4,
+		RedactHeaders: []string{"x-api-key"},
+	})
+
+	httpc := gate.HTTPClient("web")
+
+	for _, body := range []string{"first", "second body"} {
+		req, _ := http.NewRequest("POST", "http://"+gate.URI("web")+"/path?q=1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Api-Key", "secret")
+		req.Header.Set("Content-Type", "text/plain")
+
+		res, err := httpc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the visitor gets the whole body whatever the inspector keeps
+		if b, _ := io.ReadAll(res.Body); string(b) != body {
+			t.Fatalf("visitor got %q, want %q", b, body)
+		}
+
+		res.Body.Close()
+	}
+
+	res, err := httpc.Get("http://" + gate.URI("web") + "/binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	// captures are added once the handler returns, after the visitor got
+	// the response
+	var entries []*Capture
+	waitFor(t, func() bool {
+		entries = inspector.Entries()
+		return len(entries) > 0 && entries[0].Request.URL == "https://web.pinge.test/binary"
+	}, "capture of the last request")
+
+	// the oldest capture fell out of the ring
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want the last 2", len(entries))
+	}
+
+	capture := entries[1]
+	if capture.Service != "web" || capture.Request.Method != "POST" || capture.Request.URL != "https://web.pinge.test/path?q=1" {
+		t.Fatalf("unexpected capture %+v", capture)
+	}
+
+	if string(capture.Request.Body) != "seco" || !capture.Request.BodyTruncated {
+		t.Fatalf("got request body %q, truncated %v, want the first 4 bytes", capture.Request.Body, capture.Request.BodyTruncated)
+	}
+
+	if capture.Response.StatusCode != http.StatusCreated || string(capture.Response.Body) != "seco" || !capture.Response.BodyTruncated {
+		t.Fatalf("unexpected response %+v", capture.Response)
+	}
+
+	// the credentials are hidden by default, the option adds to them
+	for _, value := range []string{
+		capture.Request.Header.Get("Authorization"),
+		capture.Request.Header.Get("Cookie"),
+		capture.Request.Header.Get("X-Api-Key"),
+		capture.Response.Header.Get("Set-Cookie"),
+	} {
+		if value != redactedValue {
+			t.Fatalf("redacted header is recorded as %q", value)
+		}
+	}
+
+	admin := httptest.NewServer(NewAdminHandler(NewRegistry(), inspector))
+	t.Cleanup(admin.Close)
+
+	var summaries []CaptureSummary
+	getJSON(t, admin.URL+"/inspect/api/requests", &summaries)
+
+	if len(summaries) != 2 || summaries[1].ID != capture.ID || summaries[1].Status != http.StatusCreated {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+
+	var entry Capture
+	getJSON(t, admin.URL+"/inspect/api/requests/"+capture.ID, &entry)
+
+	if entry.ID != capture.ID || string(entry.Request.Body) != "seco" {
+		t.Fatalf("unexpected capture %+v", entry)
+	}
+
+	var har HAR
+	getJSON(t, admin.URL+"/inspect/api/har", &har)
+
+	if len(har.Log.Entries) != 2 || har.Log.Version != "1.2" {
+		t.Fatalf("got %d har entries, want 2", len(har.Log.Entries))
+	}
+
+	// har entries are oldest first
+	post, binary := har.Log.Entries[0], har.Log.Entries[1]
+
+	if post.Request.PostData == nil || post.Request.PostData.Text != "seco" || post.Request.PostData.MimeType != "text/plain" {
+		t.Fatalf("unexpected post data %+v", post.Request.PostData)
+	}
+
+	if len(post.Request.QueryString) != 1 || post.Request.QueryString[0] != (HARNameValue{Name: "q", Value: "1"}) {
+		t.Fatalf("unexpected query string %+v", post.Request.QueryString)
+	}
+
+	if post.Response.Status != http.StatusCreated || post.Response.StatusText != "Created" || post.Response.Content.Text != "seco" {
+		t.Fatalf("unexpected har response %+v", post.Response)
+	}
+
+	if binary.Response.Content.Encoding != "base64" || binary.Response.Content.Text != "//4A" {
+		t.Fatalf("binary body exported as %q in %q encoding", binary.Response.Content.Text, binary.Response.Content.Encoding)
+	}
+
+	getJSON(t, admin.URL+"/inspect/api/har?id="+capture.ID, &har)
+
+	if len(har.Log.Entries) != 1 || har.Log.Entries[0].Request.URL != capture.Request.URL {
+		t.Fatalf("unexpected har of one capture %+v", har.Log.Entries)
+	}
+
+	res, err = http.Get(admin.URL + "/inspect/api/requests/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing capture answered %s", res.Status)
+	}
+}
@@ -0,0 +1,766 @@
+package pinge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kubernetesServiceAnnotation      = "pinge.link/service"
+	kubernetesPortAnnotation         = "pinge.link/port"
+	kubernetesPrivateAnnotation      = "pinge.link/private"
+	kubernetesCustomDomainAnnotation = "pinge.link/custom-domain"
+	kubernetesURLAnnotation          = "pinge.link/url"
+
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+type KubernetesOptions struct {
+	// Server is the url of the api server, e.g. http://127.0.0.1:8001 of
+	// kubectl proxy. The agent running in a pod uses the api server of its
+	// cluster and its service account by default.
+	Server   string
+	Token    string
+	CAFile   string
+	Insecure bool
+
+	// Namespace limits the agent to one namespace, it watches every
+	// namespace by default.
+	Namespace string
+}
+
+// RunKubernetes exposes the services and pods annotated with
+// pinge.link/service until the context is done. The tunnels target the
+// cluster ip of the services and the ip of the pods, on the port given by
+// pinge.link/port, a number or a port name. The public url is written back
+// to the pinge.link/url annotation while the tunnel runs. Objects sharing a
+// service name, like the replicas of a deployment, are exposed one at a
+// time, the others wait until the exposed one stops.
+func RunKubernetes(ctx context.Context, token string, initHost string, kubernetesOptions KubernetesOptions, options ...ClientOption) error {
+	client, err := newKubeClient(kubernetesOptions)
+	if err != nil {
+		return err
+	}
+
+	w := kubernetesWatcher{
+		client:   client,
+		token:    token,
+		initHost: initHost,
+		options:  options,
+		tunnels:  make(map[string]*kubeTunnel),
+		waiting:  make(map[string]kubeWaiting),
+	}
+
+	return w.run(ctx)
+}
+
+type kubeClient struct {
+	httpc     *http.Client
+	server    string
+	token     string
+	tokenFile string
+	namespace string
+}
+
+func newKubeClient(options KubernetesOptions) (*kubeClient, error) {
+	client := kubeClient{
+		server:    strings.TrimSuffix(options.Server, "/"),
+		token:     options.Token,
+		namespace: options.Namespace,
+	}
+
+	caFile := options.CAFile
+
+	if client.server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("agent does not run in a kubernetes cluster, specify the api server")
+		}
+
+		client.server = "https://" + net.JoinHostPort(host, port)
+
+		// bound service account tokens rotate, the file is read again by
+		// every request
+		if client.token == "" {
+			client.tokenFile = filepath.Join(kubernetesServiceAccountDir, "token")
+		}
+
+		if caFile == "" {
+			caFile = filepath.Join(kubernetesServiceAccountDir, "ca.crt")
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: options.Insecure,
+	}
+
+	if caFile != "" && !options.Insecure {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+
+	client.httpc = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	return &client, nil
+}
+
+type kubeObject struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		ClusterIP  string     `json:"clusterIP"`
+		Ports      []kubePort `json:"ports"`
+		Containers []struct {
+			Ports []kubePort `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+type kubePort struct {
+	Name          string `json:"name"`
+	Port          int    `json:"port"`
+	ContainerPort int    `json:"containerPort"`
+}
+
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (k *kubeClient) do(ctx context.Context, method string, path string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := k.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	token := k.token
+	if k.tokenFile != "" {
+		b, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		token = strings.TrimSpace(string(b))
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := k.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+
+		return nil, fmt.Errorf("%s %s: %s %s", method, path, res.Status, strings.TrimSpace(string(b)))
+	}
+
+	return res, nil
+}
+
+// resourcePath returns the path of the resource of the namespace, of every
+// namespace when it is empty.
+func (k *kubeClient) resourcePath(resource string, namespace string) string {
+	if namespace == "" {
+		return "/api/v1/" + resource
+	}
+
+	return "/api/v1/namespaces/" + namespace + "/" + resource
+}
+
+// list returns the objects and the resource version to watch them from.
+func (k *kubeClient) list(ctx context.Context, resource string) ([]kubeObject, string, error) {
+	res, err := k.do(ctx, "GET", k.resourcePath(resource, k.namespace), nil, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer res.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []kubeObject `json:"items"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+// watch streams the changes of the objects after the resource version
+// until the context is done or the api server closes the stream.
+func (k *kubeClient) watch(ctx context.Context, resource string, resourceVersion string) (<-chan kubeEvent, error) {
+	res, err := k.do(ctx, "GET", k.resourcePath(resource, k.namespace), url.Values{
+		"watch":           []string{"1"},
+		"resourceVersion": []string{resourceVersion},
+	}, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan kubeEvent)
+
+	go func() {
+		defer close(ch)
+		defer res.Body.Close()
+
+		dec := json.NewDecoder(res.Body)
+
+		for {
+			var event kubeEvent
+
+			if err := dec.Decode(&event); err != nil {
+				return
+			}
+
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// annotate sets the annotations of the object, nil values remove them.
+func (k *kubeClient) annotate(ctx context.Context, resource string, namespace string, name string, annotations map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := k.do(ctx, "PATCH", k.resourcePath(resource, namespace)+"/"+name, nil, body, "application/merge-patch+json")
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	return nil
+}
+
+// kubeTunnelSpec is the tunnel of an annotated object.
+type kubeTunnelSpec struct {
+	Name         string
+	Host         string
+	Port         string
+	Private      bool
+	CustomDomain string
+}
+
+// kubeTunnelOf returns the tunnel of the service or the pod, nil when it is
+// not annotated or has no ip yet.
+func kubeTunnelOf(resource string, object kubeObject) (*kubeTunnelSpec, error) {
+	annotations := object.Metadata.Annotations
+
+	name := annotations[kubernetesServiceAnnotation]
+	if name == "" {
+		return nil, nil
+	}
+
+	spec := kubeTunnelSpec{
+		Name:         name,
+		CustomDomain: annotations[kubernetesCustomDomainAnnotation],
+	}
+
+	if value, ok := annotations[kubernetesPrivateAnnotation]; ok {
+		spec.Private = true
+
+		if value != "" {
+			private, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s annotation: %w", kubernetesPrivateAnnotation, err)
+			}
+
+			spec.Private = private
+		}
+	}
+
+	var ports []kubePort
+
+	switch resource {
+	case "services":
+		if object.Spec.ClusterIP == "" || object.Spec.ClusterIP == "None" {
+			return nil, fmt.Errorf("service has no cluster ip")
+		}
+
+		spec.Host = object.Spec.ClusterIP
+		ports = object.Spec.Ports
+	case "pods":
+		if object.Status.Phase != "Running" || object.Status.PodIP == "" {
+			return nil, nil
+		}
+
+		spec.Host = object.Status.PodIP
+
+		for _, container := range object.Spec.Containers {
+			for _, port := range container.Ports {
+				port.Port = port.ContainerPort
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	port := annotations[kubernetesPortAnnotation]
+
+	switch {
+	case port == "" && len(ports) == 1:
+		spec.Port = strconv.Itoa(ports[0].Port)
+	case port == "":
+		return nil, fmt.Errorf("%s annotation is required with %d ports", kubernetesPortAnnotation, len(ports))
+	default:
+		if _, err := strconv.Atoi(port); err == nil {
+			spec.Port = port
+			break
+		}
+
+		for _, item := range ports {
+			if item.Name == port {
+				spec.Port = strconv.Itoa(item.Port)
+			}
+		}
+
+		if spec.Port == "" {
+			return nil, fmt.Errorf("no port named %s", port)
+		}
+	}
+
+	return &spec, nil
+}
+
+// kubernetesWatcher keeps one tunnel per annotated service and pod.
+type kubernetesWatcher struct {
+	client   *kubeClient
+	token    string
+	initHost string
+	options  []ClientOption
+
+	// wg counts the running tunnels, run waits for them to remove their
+	// urls
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	tunnels map[string]*kubeTunnel
+	waiting map[string]kubeWaiting
+}
+
+type kubeTunnel struct {
+	spec    kubeTunnelSpec
+	cancel  context.CancelFunc
+	stopped bool
+	deleted bool
+	done    chan struct{}
+
+	// urlMu orders the writes of the url annotation, no url is written
+	// once ended
+	urlMu sync.Mutex
+	url   bool
+	ended bool
+}
+
+// kubeWaiting is an object whose service name is taken by another object.
+type kubeWaiting struct {
+	resource string
+	object   kubeObject
+}
+
+// kubeURLTimeout bounds the removal of the url once the tunnel ended, the
+// context of the watcher may be done already.
+const kubeURLTimeout = 10 * time.Second
+
+// run watches services and pods until the context is done. Only the first
+// lists must succeed, later errors are retried.
+func (w *kubernetesWatcher) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	for _, resource := range []string{"services", "pods"} {
+		objects, resourceVersion, err := w.client.list(ctx, resource)
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+
+		go func(resource string) {
+			defer wg.Done()
+			w.watch(ctx, resource, objects, resourceVersion)
+		}(resource)
+	}
+
+	fmt.Println("listen kubernetes services and pods")
+
+	wg.Wait()
+	w.wg.Wait()
+
+	return nil
+}
+
+func (w *kubernetesWatcher) watch(ctx context.Context, resource string, objects []kubeObject, resourceVersion string) {
+	for {
+		w.reconcile(ctx, resource, objects)
+
+		events, err := w.client.watch(ctx, resource, resourceVersion)
+		if err != nil {
+			fmt.Println("cannot watch", resource, err)
+		} else {
+			w.handle(ctx, resource, events)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		// the watch ended or expired, list again to catch missed changes
+		if objects, resourceVersion, err = w.client.list(ctx, resource); err != nil {
+			fmt.Println("cannot list", resource, err)
+		}
+	}
+}
+
+func (w *kubernetesWatcher) handle(ctx context.Context, resource string, events <-chan kubeEvent) {
+	for event := range events {
+		var object kubeObject
+
+		if err := json.Unmarshal(event.Object, &object); err != nil {
+			fmt.Println("cannot decode", resource, "event", err)
+			continue
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.apply(ctx, resource, object)
+		case "DELETED":
+			w.stop(kubeKey(resource, object), true)
+		case "ERROR":
+			// usually 410 gone, the resource version is too old
+			return
+		}
+	}
+}
+
+func kubeKey(resource string, object kubeObject) string {
+	return resource + "/" + object.Metadata.Namespace + "/" + object.Metadata.Name
+}
+
+// reconcile applies the listed objects and stops the tunnels of the
+// resource missing from the list.
+func (w *kubernetesWatcher) reconcile(ctx context.Context, resource string, objects []kubeObject) {
+	if objects == nil {
+		return
+	}
+
+	listed := make(map[string]bool)
+
+	for _, object := range objects {
+		listed[kubeKey(resource, object)] = true
+		w.apply(ctx, resource, object)
+	}
+
+	w.mu.Lock()
+	var stale []string
+	for key, tunnel := range w.tunnels {
+		if strings.HasPrefix(key, resource+"/") && !listed[key] && !tunnel.stopped {
+			stale = append(stale, key)
+		}
+	}
+
+	for key := range w.waiting {
+		if strings.HasPrefix(key, resource+"/") && !listed[key] {
+			delete(w.waiting, key)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, key := range stale {
+		w.stop(key, true)
+	}
+}
+
+// apply starts, restarts or stops the tunnel of the object after a change.
+func (w *kubernetesWatcher) apply(ctx context.Context, resource string, object kubeObject) {
+	key := kubeKey(resource, object)
+
+	spec, err := kubeTunnelOf(resource, object)
+	if err != nil {
+		fmt.Println("cannot expose", key, err)
+	}
+
+	if spec == nil {
+		// a running tunnel removes its url when it ends, the url of a tunnel
+		// of an earlier agent is removed here
+		if !w.stop(key, false) && object.Metadata.Annotations[kubernetesURLAnnotation] != "" {
+			go w.annotate(ctx, resource, object, nil)
+		}
+
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	previous, ok := w.tunnels[key]
+	if ok && !previous.stopped && previous.spec == *spec {
+		return
+	}
+
+	if owner := w.owner(key, spec.Name); owner != "" {
+		if _, ok := w.waiting[key]; !ok {
+			fmt.Println("service", spec.Name, "of", key, "waits for the same service of", owner)
+		}
+
+		w.waiting[key] = kubeWaiting{resource: resource, object: object}
+
+		if ok && !previous.stopped {
+			previous.stopped = true
+			previous.cancel()
+		}
+
+		return
+	}
+
+	delete(w.waiting, key)
+
+	if ok && !previous.stopped {
+		fmt.Println("restart service", previous.spec.Name)
+
+		previous.stopped = true
+		previous.cancel()
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	tunnel := &kubeTunnel{
+		spec:   *spec,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	w.tunnels[key] = tunnel
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+		defer close(tunnel.done)
+		defer cancel()
+
+		if previous != nil {
+			select {
+			case <-previous.done:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		options := append([]ClientOption{}, w.options...)
+
+		if w.initHost != "" {
+			options = append(options, WithTopologyAddress(w.initHost))
+		}
+
+		if spec.Private {
+			options = append(options, WithPrivate())
+		}
+
+		if spec.CustomDomain != "" {
+			options = append(options, WithCustomDomain(spec.CustomDomain))
+		}
+
+		options = append(options, WithURIHandler(func(uri string) {
+			go func() {
+				tunnel.urlMu.Lock()
+				defer tunnel.urlMu.Unlock()
+
+				if !tunnel.ended {
+					tunnel.url = true
+					w.annotate(ctx, resource, object, "https://"+uri)
+				}
+			}()
+		}))
+
+		fmt.Println("start service", spec.Name, spec.Host, spec.Port, "of", key)
+
+		w.serve(ctx, *spec, options)
+
+		w.mu.Lock()
+		if w.tunnels[key] == tunnel {
+			delete(w.tunnels, key)
+		}
+		deleted := tunnel.deleted
+		w.mu.Unlock()
+
+		tunnel.urlMu.Lock()
+		tunnel.ended = true
+		if tunnel.url && !deleted {
+			urlCtx, urlCancel := context.WithTimeout(context.Background(), kubeURLTimeout)
+			w.annotate(urlCtx, resource, object, nil)
+			urlCancel()
+		}
+		tunnel.urlMu.Unlock()
+
+		w.retry(parent, spec.Name)
+	}()
+}
+
+// serve runs the tunnel of the spec until the context is done, a failed
+// tunnel is restarted with the backoff of the agent tunnels.
+func (w *kubernetesWatcher) serve(ctx context.Context, spec kubeTunnelSpec, options []ClientOption) {
+	delay := tunnelRestartDelay
+
+	for {
+		startedAt := time.Now()
+
+		err := InitService(ctx, spec.Name, w.token, spec.Host, spec.Port, options)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(startedAt) > maxTunnelRestartDelay {
+			delay = tunnelRestartDelay
+		}
+
+		fmt.Println("service stopped with error", spec.Name, err, "restart in", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxTunnelRestartDelay {
+			delay = maxTunnelRestartDelay
+		}
+	}
+}
+
+// owner returns the key of another object whose tunnel uses the service
+// name, the caller holds the lock.
+func (w *kubernetesWatcher) owner(key string, name string) string {
+	for other, tunnel := range w.tunnels {
+		if other != key && tunnel.spec.Name == name {
+			return other
+		}
+	}
+
+	return ""
+}
+
+// retry applies the objects waiting for the service name again once its
+// tunnel ended.
+func (w *kubernetesWatcher) retry(ctx context.Context, name string) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	w.mu.Lock()
+	var waiting []kubeWaiting
+	for _, item := range w.waiting {
+		waiting = append(waiting, item)
+	}
+	w.mu.Unlock()
+
+	for _, item := range waiting {
+		if spec, _ := kubeTunnelOf(item.resource, item.object); spec != nil && spec.Name == name {
+			w.apply(ctx, item.resource, item.object)
+		}
+	}
+}
+
+// stop stops the tunnel of the object, it reports whether one was running.
+// The tunnel of a deleted object does not remove its url.
+func (w *kubernetesWatcher) stop(key string, deleted bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.waiting, key)
+
+	tunnel, ok := w.tunnels[key]
+	if ok {
+		tunnel.deleted = tunnel.deleted || deleted
+	}
+	if !ok || tunnel.stopped {
+		return false
+	}
+
+	fmt.Println("stop service", tunnel.spec.Name)
+
+	tunnel.stopped = true
+	tunnel.cancel()
+
+	return true
+}
+
+// annotate writes the url to the object, a nil url removes it.
+func (w *kubernetesWatcher) annotate(ctx context.Context, resource string, object kubeObject, value interface{}) {
+	err := w.client.annotate(ctx, resource, object.Metadata.Namespace, object.Metadata.Name, map[string]interface{}{
+		kubernetesURLAnnotation: value,
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Println("cannot annotate", kubeKey(resource, object), err)
+	}
+}
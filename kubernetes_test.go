@@ -0,0 +1,524 @@
+package pinge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+// fakeKubernetes serves the services and pods of the kubernetes api used by
+// the agent.
+type fakeKubernetes struct {
+	mu       sync.Mutex
+	version  int
+	objects  map[string]map[string]kubeObject
+	watchers map[chan kubeEvent]string
+}
+
+func newFakeKubernetes(t *testing.T) *httptest.Server {
+	k := fakeKubernetes{
+		objects: map[string]map[string]kubeObject{
+			"services": {},
+			"pods":     {},
+		},
+		watchers: make(map[chan kubeEvent]string),
+	}
+
+	server := httptest.NewServer(&k)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer kube-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+
+	var namespace, resource, name string
+
+	switch len(parts) {
+	case 1:
+		resource = parts[0]
+	case 3:
+		namespace, resource = parts[1], parts[2]
+	case 4:
+		namespace, resource, name = parts[1], parts[2], parts[3]
+	}
+
+	if _, ok := k.objects[resource]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == "PATCH" && name != "":
+		var patch struct {
+			Metadata struct {
+				Annotations map[string]*string `json:"annotations"`
+			} `json:"metadata"`
+		}
+
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" || json.NewDecoder(r.Body).Decode(&patch) != nil {
+			http.Error(w, "bad patch", http.StatusBadRequest)
+			return
+		}
+
+		k.mu.Lock()
+		object, ok := k.objects[resource][namespace+"/"+name]
+		if ok {
+			annotations := make(map[string]string)
+			for key, value := range object.Metadata.Annotations {
+				annotations[key] = value
+			}
+
+			for key, value := range patch.Metadata.Annotations {
+				if value == nil {
+					delete(annotations, key)
+				} else {
+					annotations[key] = *value
+				}
+			}
+
+			object.Metadata.Annotations = annotations
+		}
+		k.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		k.put(resource, object)
+		json.NewEncoder(w).Encode(object)
+	case r.Method == "GET" && r.URL.Query().Get("watch") == "1":
+		ch := make(chan kubeEvent, 16)
+
+		k.mu.Lock()
+		k.watchers[ch] = resource
+		k.mu.Unlock()
+
+		defer func() {
+			k.mu.Lock()
+			delete(k.watchers, ch)
+			k.mu.Unlock()
+		}()
+
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case event := <-ch:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case r.Method == "GET":
+		k.mu.Lock()
+		list := map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": strconv.Itoa(k.version)},
+		}
+
+		items := []kubeObject{}
+		for _, object := range k.objects[resource] {
+			items = append(items, object)
+		}
+
+		list["items"] = items
+		k.mu.Unlock()
+
+		json.NewEncoder(w).Encode(list)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (k *fakeKubernetes) put(resource string, object kubeObject) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := object.Metadata.Namespace + "/" + object.Metadata.Name
+
+	eventType := "MODIFIED"
+	if _, ok := k.objects[resource][key]; !ok {
+		eventType = "ADDED"
+	}
+
+	k.version++
+	object.Metadata.ResourceVersion = strconv.Itoa(k.version)
+	k.objects[resource][key] = object
+
+	k.emit(resource, eventType, object)
+}
+
+func (k *fakeKubernetes) delete(resource string, namespace string, name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	object, ok := k.objects[resource][namespace+"/"+name]
+	if !ok {
+		return
+	}
+
+	k.version++
+	delete(k.objects[resource], namespace+"/"+name)
+
+	k.emit(resource, "DELETED", object)
+}
+
+func (k *fakeKubernetes) emit(resource string, eventType string, object kubeObject) {
+	b, _ := json.Marshal(object)
+
+	for ch, watched := range k.watchers {
+		if watched == resource {
+			ch <- kubeEvent{Type: eventType, Object: b}
+		}
+	}
+}
+
+func (k *fakeKubernetes) get(resource string, namespace string, name string) (kubeObject, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	object, ok := k.objects[resource][namespace+"/"+name]
+
+	return object, ok
+}
+
+func (k *fakeKubernetes) watching() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.watchers)
+}
+
+func newKubeService(name string, annotations map[string]string, ports ...kubePort) kubeObject {
+	var object kubeObject
+	object.Metadata.Name = name
+	object.Metadata.Namespace = "default"
+	object.Metadata.Annotations = annotations
+	object.Spec.ClusterIP = "127.0.0.1"
+	object.Spec.Ports = ports
+
+	return object
+}
+
+func TestKubernetes(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	server := newFakeKubernetes(t)
+	kube := server.Config.Handler.(*fakeKubernetes)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+	echoPort, _ := strconv.Atoi(port)
+
+	web := newKubeService("web",
+		map[string]string{kubernetesServiceAnnotation: "web", kubernetesPortAnnotation: "http"},
+		kubePort{Name: "metrics", Port: 1},
+		kubePort{Name: "http", Port: echoPort},
+	)
+
+	kube.put("services", web)
+	kube.put("services", newKubeService("other", nil, kubePort{Port: echoPort}))
+
+	var worker kubeObject
+	worker.Metadata.Name = "worker"
+	worker.Metadata.Namespace = "jobs"
+	worker.Metadata.Annotations = map[string]string{kubernetesServiceAnnotation: "worker", kubernetesPrivateAnnotation: ""}
+	worker.Status.Phase = "Pending"
+	worker.Spec.Containers = append(worker.Spec.Containers, struct {
+		Ports []kubePort `json:"ports"`
+	}{Ports: []kubePort{{ContainerPort: echoPort}}})
+
+	kube.put("pods", worker)
+
+	go RunKubernetes(ctx, "token", topology.URL(), KubernetesOptions{
+		Server: server.URL,
+		Token:  "kube-token",
+	})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gate.Dial(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("ping"))
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("got %q, %v from web service", b, err)
+	}
+
+	conn.Close()
+
+	waitFor(t, func() bool {
+		object, _ := kube.get("services", "default", "web")
+		return object.Metadata.Annotations[kubernetesURLAnnotation] == "https://"+gate.URI("web")
+	}, "url annotation of web")
+
+	waitFor(t, func() bool { return kube.watching() == 2 }, "watches of services and pods")
+
+	// the pod is exposed once it runs
+	worker.Status.Phase = "Running"
+	worker.Status.PodIP = "127.0.0.1"
+	kube.put("pods", worker)
+
+	if err := gate.WaitConnected(ctx, "worker", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the annotation stops the tunnel and removes the url
+	web, _ = kube.get("services", "default", "web")
+	web.Metadata.Annotations = map[string]string{kubernetesURLAnnotation: web.Metadata.Annotations[kubernetesURLAnnotation]}
+	kube.put("services", web)
+
+	if err := gate.WaitConnected(ctx, "web", false); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		object, _ := kube.get("services", "default", "web")
+		_, ok := object.Metadata.Annotations[kubernetesURLAnnotation]
+		return !ok
+	}, "url annotation of web removed")
+
+	kube.delete("pods", "jobs", "worker")
+
+	if err := gate.WaitConnected(ctx, "worker", false); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, req := range gate.ConnectRequests() {
+		if req.ServiceName == "other" {
+			t.Fatal("service without annotations is exposed")
+		}
+
+		if req.Private != (req.ServiceName == "worker") {
+			t.Fatalf("unexpected connect request %+v", req)
+		}
+	}
+
+	if n := countConnects(gate, "web"); n != 1 {
+		t.Fatalf("web connected %d times, want 1", n)
+	}
+}
+
+func TestKubeTunnelOf(t *testing.T) {
+	service := newKubeService("web", map[string]string{kubernetesServiceAnnotation: "web"}, kubePort{Name: "http", Port: 80})
+
+	spec, err := kubeTunnelOf("services", service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *spec != (kubeTunnelSpec{Name: "web", Host: "127.0.0.1", Port: "80"}) {
+		t.Fatalf("unexpected tunnel %+v", spec)
+	}
+
+	service.Spec.Ports = append(service.Spec.Ports, kubePort{Name: "admin", Port: 9000})
+
+	if _, err := kubeTunnelOf("services", service); err == nil {
+		t.Fatal("service with two ports and no port annotation is exposed")
+	}
+
+	service.Metadata.Annotations[kubernetesPortAnnotation] = "admin"
+	service.Metadata.Annotations[kubernetesPrivateAnnotation] = "true"
+	service.Metadata.Annotations[kubernetesCustomDomainAnnotation] = "example.com"
+
+	spec, err = kubeTunnelOf("services", service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *spec != (kubeTunnelSpec{Name: "web", Host: "127.0.0.1", Port: "9000", Private: true, CustomDomain: "example.com"}) {
+		t.Fatalf("unexpected tunnel %+v", spec)
+	}
+
+	service.Metadata.Annotations[kubernetesPortAnnotation] = "missing"
+
+	if _, err := kubeTunnelOf("services", service); err == nil {
+		t.Fatal("unknown port name is accepted")
+	}
+
+	service.Spec.ClusterIP = "None"
+	service.Metadata.Annotations[kubernetesPortAnnotation] = "80"
+
+	if _, err := kubeTunnelOf("services", service); err == nil {
+		t.Fatal("headless service is exposed")
+	}
+
+	delete(service.Metadata.Annotations, kubernetesServiceAnnotation)
+
+	if spec, err := kubeTunnelOf("services", service); spec != nil || err != nil {
+		t.Fatalf("service without annotation gives %+v, %v", spec, err)
+	}
+}
+
+func TestKubernetesUnauthorized(t *testing.T) {
+	server := newFakeKubernetes(t)
+
+	err := RunKubernetes(testContext(t), "token", "", KubernetesOptions{
+		Server: server.URL,
+		Token:  "invalid",
+	})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got error %v, want unauthorized", err)
+	}
+}
+
+func TestKubernetesRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(testContext(t))
+	defer cancel()
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	server := newFakeKubernetes(t)
+	kube := server.Config.Handler.(*fakeKubernetes)
+
+	gate.FailNext(pingetest.ErrInvalidToken)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+	echoPort, _ := strconv.Atoi(port)
+
+	kube.put("services", newKubeService("web", map[string]string{kubernetesServiceAnnotation: "web"}, kubePort{Port: echoPort}))
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- RunKubernetes(ctx, "token", topology.URL(), KubernetesOptions{
+			Server: server.URL,
+			Token:  "kube-token",
+		})
+	}()
+
+	// no watch event follows the failed connect
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countConnects(gate, "web"); n != 2 {
+		t.Fatalf("got %d connects, want 2", n)
+	}
+
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent does not stop")
+	}
+}
+
+func newKubePod(name string, annotations map[string]string, port int) kubeObject {
+	var object kubeObject
+	object.Metadata.Name = name
+	object.Metadata.Namespace = "default"
+	object.Metadata.Annotations = annotations
+	object.Status.Phase = "Running"
+	object.Status.PodIP = "127.0.0.1"
+	object.Spec.Containers = append(object.Spec.Containers, struct {
+		Ports []kubePort `json:"ports"`
+	}{Ports: []kubePort{{ContainerPort: port}}})
+
+	return object
+}
+
+func kubeURL(kube *fakeKubernetes, resource string, name string) string {
+	object, _ := kube.get(resource, "default", name)
+	return object.Metadata.Annotations[kubernetesURLAnnotation]
+}
+
+func TestKubernetesSharedName(t *testing.T) {
+	ctx, cancel := context.WithCancel(testContext(t))
+	defer cancel()
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	server := newFakeKubernetes(t)
+	kube := server.Config.Handler.(*fakeKubernetes)
+
+	_, port, _ := net.SplitHostPort(newEchoServer(t))
+	echoPort, _ := strconv.Atoi(port)
+
+	// the replicas of a deployment share the annotations of the template
+	annotations := map[string]string{kubernetesServiceAnnotation: "web"}
+	kube.put("pods", newKubePod("web-1", annotations, echoPort))
+	kube.put("pods", newKubePod("web-2", annotations, echoPort))
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- RunKubernetes(ctx, "token", topology.URL(), KubernetesOptions{
+			Server: server.URL,
+			Token:  "kube-token",
+		})
+	}()
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var exposed, other string
+	waitFor(t, func() bool {
+		for _, name := range []string{"web-1", "web-2"} {
+			if kubeURL(kube, "pods", name) != "" {
+				exposed = name
+			} else {
+				other = name
+			}
+		}
+
+		return exposed != "" && other != ""
+	}, "url annotation of one replica")
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := countConnects(gate, "web"); n != 1 || kubeURL(kube, "pods", other) != "" {
+		t.Fatalf("web connected %d times, want 1 replica exposed", n)
+	}
+
+	// the waiting replica takes over once the exposed one is gone
+	kube.delete("pods", "default", exposed)
+
+	waitFor(t, func() bool {
+		return kubeURL(kube, "pods", other) == "https://"+gate.URI("web")
+	}, "url annotation of the other replica")
+
+	if n := countConnects(gate, "web"); n != 2 {
+		t.Fatalf("web connected %d times, want 2", n)
+	}
+
+	// the agent removes its urls when it exits
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent does not stop")
+	}
+
+	if url := kubeURL(kube, "pods", other); url != "" {
+		t.Fatalf("url %s is left after the agent stopped", url)
+	}
+}
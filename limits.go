@@ -0,0 +1,232 @@
+package pinge
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	rejectMaxConnections = "max_connections"
+	rejectConnectionRate = "connection_rate"
+)
+
+// LimitOptions protect the local backend of a tunnel from a visitor opening
+// too many connections. Byte rates count both directions together.
+type LimitOptions struct {
+	MaxConnections int `json:"max_connections,omitempty"`
+	// QueueTimeout keeps connections over MaxConnections waiting for a free
+	// slot, they are rejected at once without it.
+	QueueTimeout         Duration `json:"queue_timeout,omitempty"`
+	ConnectionsPerSecond float64  `json:"connections_per_second,omitempty"`
+	BytesPerSecond       int64    `json:"bytes_per_second,omitempty"`
+	TunnelBytesPerSecond int64    `json:"tunnel_bytes_per_second,omitempty"`
+}
+
+func WithLimits(options LimitOptions) ClientOption {
+	return func(c *Client) {
+		c.limits = newLimiter(options)
+	}
+}
+
+type limiter struct {
+	options     LimitOptions
+	slots       chan struct{}
+	connections *tokenBucket
+	bytes       *tokenBucket
+}
+
+func newLimiter(options LimitOptions) *limiter {
+	l := limiter{
+		options: options,
+	}
+
+	if options.MaxConnections > 0 {
+		l.slots = make(chan struct{}, options.MaxConnections)
+	}
+
+	if options.ConnectionsPerSecond > 0 {
+		l.connections = newTokenBucket(options.ConnectionsPerSecond)
+	}
+
+	if options.TunnelBytesPerSecond > 0 {
+		l.bytes = newTokenBucket(float64(options.TunnelBytesPerSecond))
+	}
+
+	return &l
+}
+
+// admit waits for a free slot and wraps the connection with the byte rate
+// limits. It returns the reason when the connection must be rejected.
+func (l *limiter) admit(ctx context.Context, conn net.Conn) (net.Conn, string) {
+	if l.connections != nil && !l.connections.take(1) {
+		return nil, rejectConnectionRate
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.options.QueueTimeout <= 0 {
+				return nil, rejectMaxConnections
+			}
+
+			timer := time.NewTimer(time.Duration(l.options.QueueTimeout))
+			defer timer.Stop()
+
+			select {
+			case l.slots <- struct{}{}:
+			case <-timer.C:
+				return nil, rejectMaxConnections
+			case <-ctx.Done():
+				return nil, rejectMaxConnections
+			}
+		}
+	}
+
+	limited := &limitedConn{
+		Conn:    conn,
+		ctx:     ctx,
+		limiter: l,
+	}
+
+	if l.options.BytesPerSecond > 0 {
+		limited.bytes = newTokenBucket(float64(l.options.BytesPerSecond))
+	}
+
+	return limited, ""
+}
+
+type limitedConn struct {
+	net.Conn
+	ctx       context.Context
+	limiter   *limiter
+	bytes     *tokenBucket
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) wait(n int) error {
+	if c.bytes != nil {
+		if err := c.bytes.wait(c.ctx, n); err != nil {
+			return err
+		}
+	}
+
+	if c.limiter.bytes != nil {
+		if err := c.limiter.bytes.wait(c.ctx, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if waitErr := c.wait(n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if err := c.wait(len(b)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.limiter.slots != nil {
+			<-c.limiter.slots
+		}
+	})
+
+	return c.Conn.Close()
+}
+
+// tokenBucket allows rate tokens per second with bursts of one second, and
+// of one token at least, so that rates below one still let a token through.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+}
+
+func (b *tokenBucket) take(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+
+	return true
+}
+
+// wait takes n tokens, going into debt when n is larger than the burst, and
+// sleeps until the debt is paid.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,222 @@
+package pinge
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		burst int
+	}{
+		{rate: 0.5, burst: 1},
+		{rate: 1, burst: 1},
+		{rate: 3, burst: 3},
+		{rate: 2.5, burst: 2},
+	}
+
+	for _, test := range tests {
+		b := newTokenBucket(test.rate)
+
+		for i := 0; i < test.burst; i++ {
+			if !b.take(1) {
+				t.Fatalf("rate %v: token %d of the burst is refused", test.rate, i+1)
+			}
+		}
+
+		if b.take(1) {
+			t.Fatalf("rate %v: burst is larger than %d", test.rate, test.burst)
+		}
+
+		// one token comes back after 1/rate seconds
+		b.mu.Lock()
+		b.last = b.last.Add(-time.Duration(float64(time.Second) / test.rate))
+		b.mu.Unlock()
+
+		if !b.take(1) {
+			t.Fatalf("rate %v: bucket does not refill", test.rate)
+		}
+
+		if b.take(1) {
+			t.Fatalf("rate %v: bucket refills too fast", test.rate)
+		}
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := newTokenBucket(10000)
+
+	start := time.Now()
+
+	// the burst is free, the debt of 5000 tokens takes half a second
+	if err := b.wait(context.Background(), 15000); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("waited %s, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.wait(ctx, 100000); err != context.Canceled {
+		t.Fatalf("got %v, want the context error", err)
+	}
+}
+
+func TestLimiterMaxConnections(t *testing.T) {
+	ctx := testContext(t)
+
+	l := newLimiter(LimitOptions{MaxConnections: 2})
+
+	var conns []net.Conn
+
+	for i := 0; i < 2; i++ {
+		conn, _ := tcpPair(t)
+
+		admitted, reason := l.admit(ctx, conn)
+		if reason != "" {
+			t.Fatalf("connection %d rejected: %s", i+1, reason)
+		}
+
+		conns = append(conns, admitted)
+	}
+
+	extra, _ := tcpPair(t)
+	if _, reason := l.admit(ctx, extra); reason != rejectMaxConnections {
+		t.Fatalf("got %q for a connection over the limit", reason)
+	}
+
+	conns[0].Close()
+	conns[0].Close()
+
+	if _, reason := l.admit(ctx, extra); reason != "" {
+		t.Fatalf("connection rejected after a slot is free: %s", reason)
+	}
+
+	if _, reason := l.admit(ctx, extra); reason != rejectMaxConnections {
+		t.Fatal("double close freed two slots")
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	ctx := testContext(t)
+
+	l := newLimiter(LimitOptions{MaxConnections: 1, QueueTimeout: Duration(100 * time.Millisecond)})
+
+	first, _ := tcpPair(t)
+	admitted, _ := l.admit(ctx, first)
+
+	// the queue times out
+	second, _ := tcpPair(t)
+	start := time.Now()
+
+	if _, reason := l.admit(ctx, second); reason != rejectMaxConnections || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("got %q after %s, want a rejection after the queue timeout", reason, time.Since(start))
+	}
+
+	// a queued connection takes the slot freed meanwhile
+	time.AfterFunc(20*time.Millisecond, func() { admitted.Close() })
+
+	if _, reason := l.admit(ctx, second); reason != "" {
+		t.Fatalf("queued connection rejected: %s", reason)
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	ctx := testContext(t)
+
+	l := newLimiter(LimitOptions{MaxConnections: 3, QueueTimeout: Duration(10 * time.Second)})
+
+	var mu sync.Mutex
+	var active, peak int
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		conn, _ := tcpPair(t)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			admitted, reason := l.admit(ctx, conn)
+			if reason != "" {
+				t.Error(reason)
+				return
+			}
+
+			mu.Lock()
+			active++
+			if active > peak {
+				peak = active
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+
+			admitted.Close()
+		}()
+	}
+
+	wg.Wait()
+
+	if peak != 3 {
+		t.Fatalf("got %d connections at once, want 3", peak)
+	}
+}
+
+func TestFractionalConnectionRate(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	registry := NewRegistry()
+
+	go InitServiceTarget(ctx, "echo", "token", newEchoServer(t), []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithRegistry(registry),
+		WithLimits(LimitOptions{ConnectionsPerSecond: 0.5}),
+	})
+
+	if err := gate.WaitConnected(ctx, "echo", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := gate.Dial(ctx, "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write([]byte("ping"))
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 4))
+		conn.Close()
+
+		if i == 0 && err != nil {
+			t.Fatalf("first connection refused: %v", err)
+		}
+
+		if i == 1 && err == nil {
+			t.Fatal("second connection within two seconds is accepted")
+		}
+	}
+
+	if n := registry.Clients()[0].Status().Rejected[rejectConnectionRate]; n != 1 {
+		t.Fatalf("got %d rejections, want 1", n)
+	}
+}
@@ -0,0 +1,61 @@
+package pinge
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+func (c *Client) recordRejection(reason string) {
+	c.mu.Lock()
+	c.rejected[reason]++
+	c.mu.Unlock()
+}
+
+func (c *Client) Rejections() map[string]int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	rejected := make(map[string]int64, len(c.rejected))
+	for reason, n := range c.rejected {
+		rejected[reason] = n
+	}
+
+	return rejected
+}
+
+// writeMetrics writes the counters of the clients in the prometheus text
+// format.
+func writeMetrics(w io.Writer, clients []*Client) {
+	fmt.Fprintln(w, "# HELP pinge_reconnects_total Reconnects of the tunnel to the gate.")
+	fmt.Fprintln(w, "# TYPE pinge_reconnects_total counter")
+
+	for _, c := range clients {
+		fmt.Fprintf(w, "pinge_reconnects_total{service=%q} %d\n", c.serviceName, c.Status().Reconnects)
+	}
+
+	fmt.Fprintln(w, "# HELP pinge_connections Open proxied connections.")
+	fmt.Fprintln(w, "# TYPE pinge_connections gauge")
+
+	for _, c := range clients {
+		fmt.Fprintf(w, "pinge_connections{service=%q} %d\n", c.serviceName, len(c.Connections()))
+	}
+
+	fmt.Fprintln(w, "# HELP pinge_rejected_total Connections and requests rejected by the tunnel access control.")
+	fmt.Fprintln(w, "# TYPE pinge_rejected_total counter")
+
+	for _, c := range clients {
+		rejected := c.Rejections()
+
+		reasons := make([]string, 0, len(rejected))
+		for reason := range rejected {
+			reasons = append(reasons, reason)
+		}
+
+		sort.Strings(reasons)
+
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "pinge_rejected_total{service=%q,reason=%q} %d\n", c.serviceName, reason, rejected[reason])
+		}
+	}
+}
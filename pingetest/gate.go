@@ -0,0 +1,411 @@
+package pingetest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pinge-link/sdk/spec"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrServiceExist = status.Error(codes.AlreadyExists, "service exist")
+	ErrInvalidToken = status.Error(codes.Unauthenticated, "cannot get token")
+	ErrDisconnected = status.Error(codes.Unavailable, "gate is shutting down")
+)
+
+// Handshake is the first line sent by the agent on the secondary gate
+// connection.
+type Handshake struct {
+	Kind    int    `json:"kind"`
+	Token   string `json:"token"`
+	Service string `json:"service"`
+	Private bool   `json:"private,omitempty"`
+}
+
+type GateOption func(*Gate)
+
+// WithTokens makes the gate reject connects with other tokens with
+// ErrInvalidToken.
+func WithTokens(tokens ...string) GateOption {
+	return func(g *Gate) {
+		g.tokens = make(map[string]bool)
+		for _, token := range tokens {
+			g.tokens[token] = true
+		}
+	}
+}
+
+// WithDomain sets the domain of the service uris, pinge.test by default.
+func WithDomain(domain string) GateOption {
+	return func(g *Gate) {
+		g.domain = domain
+	}
+}
+
+// WithPingDelay slows down the answers to pings, e.g. to make the region of
+// the gate look farther than another one.
+func WithPingDelay(delay time.Duration) GateOption {
+	return func(g *Gate) {
+		g.pingDelay = delay
+	}
+}
+
+// Gate is a fake gate. The grpc server on the primary address implements
+// Connect and Ping, the secondary address accepts the connections the agent
+// opens for visitors.
+type Gate struct {
+	spec.UnimplementedServiceServer
+
+	domain    string
+	tokens    map[string]bool
+	pingDelay time.Duration
+
+	grpcServer        *grpc.Server
+	primaryListener   net.Listener
+	secondaryListener net.Listener
+
+	mu         sync.Mutex
+	services   map[string]*gateService
+	requests   []*spec.ConnectRequest
+	handshakes []Handshake
+	failures   []error
+	pings      int
+	changed    chan struct{}
+}
+
+type gateService struct {
+	stream     spec.Service_ConnectServer
+	disconnect chan error
+	pending    chan chan net.Conn
+
+	// sendMu serializes the sends, a grpc stream allows one sender at a time
+	sendMu sync.Mutex
+}
+
+func (s *gateService) send(cmd *spec.Command) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	return s.stream.Send(cmd)
+}
+
+func NewGate(options ...GateOption) (*Gate, error) {
+	g := Gate{
+		domain:   "pinge.test",
+		services: make(map[string]*gateService),
+		changed:  make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(&g)
+	}
+
+	var err error
+
+	if g.primaryListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+
+	if g.secondaryListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		g.primaryListener.Close()
+		return nil, err
+	}
+
+	g.grpcServer = grpc.NewServer()
+	spec.RegisterServiceServer(g.grpcServer, &g)
+
+	go g.grpcServer.Serve(g.primaryListener)
+	go g.acceptSecondary()
+
+	return &g, nil
+}
+
+func (g *Gate) PrimaryAddress() string {
+	return g.primaryListener.Addr().String()
+}
+
+func (g *Gate) SecondaryAddress() string {
+	return g.secondaryListener.Addr().String()
+}
+
+func (g *Gate) Close() {
+	g.grpcServer.Stop()
+	g.secondaryListener.Close()
+}
+
+// URI returns the uri the gate sends to the service.
+func (g *Gate) URI(service string) string {
+	return service + "." + g.domain
+}
+
+// FailNext makes the next connects fail with the errors, one error per
+// connect, e.g. ErrServiceExist.
+func (g *Gate) FailNext(errs ...error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.failures = append(g.failures, errs...)
+}
+
+// ConnectRequests returns every connect received by the gate.
+func (g *Gate) ConnectRequests() []*spec.ConnectRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]*spec.ConnectRequest{}, g.requests...)
+}
+
+// Handshakes returns every handshake received on the secondary address.
+func (g *Gate) Handshakes() []Handshake {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]Handshake{}, g.handshakes...)
+}
+
+func (g *Gate) Pings() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.pings
+}
+
+func (g *Gate) Connected(service string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.services[service]
+
+	return ok
+}
+
+// WaitConnected waits until the service is connected to the gate, or is not
+// connected anymore when connected is false.
+func (g *Gate) WaitConnected(ctx context.Context, service string, connected bool) error {
+	for {
+		g.mu.Lock()
+		_, ok := g.services[service]
+		changed := g.changed
+		g.mu.Unlock()
+
+		if ok == connected {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("service %s connected=%v: %w", service, ok, ctx.Err())
+		}
+	}
+}
+
+// Disconnect drops the connect stream of the service with the error,
+// ErrDisconnected when it is nil.
+func (g *Gate) Disconnect(service string, err error) bool {
+	if err == nil {
+		err = ErrDisconnected
+	}
+
+	g.mu.Lock()
+	s, ok := g.services[service]
+	g.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case s.disconnect <- err:
+	default:
+	}
+
+	return true
+}
+
+// Dial acts as a public visitor of the service: it asks the agent to open a
+// connection and returns the gate end of it.
+func (g *Gate) Dial(ctx context.Context, service string) (net.Conn, error) {
+	g.mu.Lock()
+	s, ok := g.services[service]
+	g.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("service %s is not connected", service)
+	}
+
+	ch := make(chan net.Conn, 1)
+
+	select {
+	case s.pending <- ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if err := s.send(&spec.Command{Kind: spec.Type_OPEN}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// HTTPClient sends its requests to the service as a public visitor.
+func (g *Gate) HTTPClient(service string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return g.Dial(ctx, service)
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+func (g *Gate) Connect(req *spec.ConnectRequest, stream spec.Service_ConnectServer) error {
+	g.mu.Lock()
+	g.requests = append(g.requests, req)
+
+	if len(g.failures) > 0 {
+		err := g.failures[0]
+		g.failures = g.failures[1:]
+		g.mu.Unlock()
+
+		return err
+	}
+
+	if g.tokens != nil && !g.tokens[req.Token] {
+		g.mu.Unlock()
+		return ErrInvalidToken
+	}
+
+	if _, ok := g.services[req.ServiceName]; ok {
+		g.mu.Unlock()
+		return ErrServiceExist
+	}
+
+	s := &gateService{
+		stream:     stream,
+		disconnect: make(chan error, 1),
+		pending:    make(chan chan net.Conn, 64),
+	}
+
+	g.services[req.ServiceName] = s
+	g.notify()
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.services, req.ServiceName)
+		g.notify()
+		g.mu.Unlock()
+	}()
+
+	if err := s.send(&spec.Command{Kind: spec.Type_SET_INFO, ProjectUri: g.URI(req.ServiceName)}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-s.disconnect:
+		return err
+	case <-stream.Context().Done():
+		return nil
+	}
+}
+
+func (g *Gate) Ping(ctx context.Context, req *spec.PingRequestResponse) (*spec.PingRequestResponse, error) {
+	g.mu.Lock()
+	g.pings++
+	g.mu.Unlock()
+
+	select {
+	case <-time.After(g.pingDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return req, nil
+}
+
+func (g *Gate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *Gate) acceptSecondary() {
+	for {
+		conn, err := g.secondaryListener.Accept()
+		if err != nil {
+			return
+		}
+
+		go g.handshake(conn)
+	}
+}
+
+func (g *Gate) handshake(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var handshake Handshake
+
+	if err := json.Unmarshal(line, &handshake); err != nil {
+		conn.Close()
+		return
+	}
+
+	g.mu.Lock()
+	g.handshakes = append(g.handshakes, handshake)
+	s, ok := g.services[handshake.Service]
+	g.mu.Unlock()
+
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	select {
+	case ch := <-s.pending:
+		ch <- &bufferedConn{Conn: conn, r: r}
+	default:
+		conn.Close()
+	}
+}
+
+// bufferedConn keeps the bytes read together with the handshake.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
@@ -0,0 +1,113 @@
+package pingetest_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pinge "github.com/pinge-link/sdk"
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestGate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	gate, err := pingetest.NewGate(pingetest.WithTokens("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gate.Close()
+
+	topology := pingetest.NewTopology(pingetest.NewRegion("local", gate))
+	defer topology.Close()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	go pinge.InitServiceTarget(ctx, "echo", "token", backend.Addr().String(), []pinge.ClientOption{
+		pinge.WithTopologyAddress(topology.URL()),
+	})
+
+	if err := gate.WaitConnected(ctx, "echo", true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gate.Dial(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hello" {
+		t.Fatalf("got %q, want hello", b)
+	}
+
+	if topology.Requests() != 1 || gate.Pings() == 0 {
+		t.Fatalf("topology requests %d, pings %d", topology.Requests(), gate.Pings())
+	}
+
+	handshakes := gate.Handshakes()
+	if len(handshakes) != 1 || handshakes[0] != (pingetest.Handshake{Kind: 3, Token: "token", Service: "echo"}) {
+		t.Fatalf("unexpected handshakes %+v", handshakes)
+	}
+
+	// the dials send on the stream of the service at the same time
+	errs := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		go func() {
+			conn, err := gate.Dial(ctx, "echo")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			conn.Write([]byte("hello"))
+
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+
+	if err := gate.WaitConnected(context.Background(), "echo", false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+// Package pingetest runs fake pinge topology servers and gates in process,
+// so that code using the sdk can be tested without pinge.dev.
+//
+//	gate, _ := pingetest.NewGate()
+//	defer gate.Close()
+//
+//	topology := pingetest.NewTopology(pingetest.NewRegion("local", gate))
+//	defer topology.Close()
+//
+//	go pinge.InitService(ctx, "app", "token", "localhost", "8080",
+//		[]pinge.ClientOption{pinge.WithTopologyAddress(topology.URL())})
+//
+//	conn, _ := gate.Dial(ctx, "app") // talk to the app as a visitor
+package pingetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// The types mirror the topology config of the sdk, this package does not
+// import the sdk so that its own tests can use it.
+type Config struct {
+	Regions []Region
+}
+
+type Region struct {
+	Id       string       `json:"id"`
+	PingHost string       `json:"ping_host"`
+	Gates    []GateConfig `json:"gates"`
+}
+
+type GateConfig struct {
+	SecondaryAddress string `json:"secondary_address"`
+	PrimaryAddress   string `json:"primary_address"`
+}
+
+// NewRegion describes a region served by the gates, the first gate answers
+// pings of the region.
+func NewRegion(id string, gates ...*Gate) Region {
+	region := Region{
+		Id: id,
+	}
+
+	for _, gate := range gates {
+		region.Gates = append(region.Gates, GateConfig{
+			SecondaryAddress: gate.SecondaryAddress(),
+			PrimaryAddress:   gate.PrimaryAddress(),
+		})
+	}
+
+	if len(gates) > 0 {
+		region.PingHost = gates[0].PrimaryAddress()
+	}
+
+	return region
+}
+
+// Topology is a fake topology http server.
+type Topology struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	config   Config
+	requests int
+}
+
+func NewTopology(regions ...Region) *Topology {
+	t := Topology{
+		config: Config{
+			Regions: regions,
+		},
+	}
+
+	t.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		t.requests++
+		config := t.config
+		t.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}))
+
+	return &t
+}
+
+// URL is passed to pinge.WithTopologyAddress.
+func (t *Topology) URL() string {
+	return t.server.URL
+}
+
+func (t *Topology) SetRegions(regions ...Region) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.config.Regions = regions
+}
+
+// Requests returns how many times the topology was fetched.
+func (t *Topology) Requests() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.requests
+}
+
+func (t *Topology) Close() {
+	t.server.Close()
+}
@@ -0,0 +1,158 @@
+package pinge
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	closeReasonEOF         = "eof"
+	closeReasonIdle        = "idle timeout"
+	closeReasonMaxLifetime = "max lifetime"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipeResult describes both directions of a proxied connection. The visitor
+// side is the copy from the visitor to the backend, the backend side is the
+// copy back.
+type pipeResult struct {
+	VisitorBytes  int64
+	VisitorReason string
+	BackendBytes  int64
+	BackendReason string
+}
+
+// pipe copies the connections into each other until both directions are
+// done. A FIN from one side is passed to the other one with CloseWrite, so
+// that half-closed connections keep working. The connections are closed when
+// nothing was sent during idleTimeout or after maxLifetime, zero disables
+// them.
+func pipe(visitor net.Conn, backend net.Conn, idleTimeout time.Duration, maxLifetime time.Duration) pipeResult {
+	var result pipeResult
+
+	lastActivity := time.Now().UnixNano()
+
+	var forcedMu sync.Mutex
+	var forced string
+
+	closeBoth := func(reason string) {
+		forcedMu.Lock()
+		if forced == "" {
+			forced = reason
+		}
+		forcedMu.Unlock()
+
+		visitor.Close()
+		backend.Close()
+	}
+
+	forcedReason := func() string {
+		forcedMu.Lock()
+		defer forcedMu.Unlock()
+
+		return forced
+	}
+
+	done := make(chan struct{})
+
+	if maxLifetime > 0 {
+		timer := time.AfterFunc(maxLifetime, func() {
+			closeBoth(closeReasonMaxLifetime)
+		})
+
+		defer timer.Stop()
+	}
+
+	if idleTimeout > 0 {
+		go func() {
+			wait := idleTimeout
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(wait):
+				}
+
+				idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+				if idle >= idleTimeout {
+					closeBoth(closeReasonIdle)
+					return
+				}
+
+				wait = idleTimeout - idle
+			}
+		}()
+	}
+
+	copyHalf := func(dst net.Conn, src net.Conn, written *int64) string {
+		buf := make([]byte, 32*1024)
+
+		for {
+			nr, readErr := src.Read(buf)
+			if nr > 0 {
+				atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+
+				nw, writeErr := dst.Write(buf[:nr])
+				atomic.AddInt64(written, int64(nw))
+
+				if writeErr != nil {
+					closeBoth("")
+					return errorReason(writeErr, forcedReason())
+				}
+			}
+
+			if readErr == io.EOF {
+				if cw, ok := dst.(closeWriter); ok {
+					cw.CloseWrite()
+				} else {
+					dst.Close()
+				}
+
+				return closeReasonEOF
+			}
+
+			if readErr != nil {
+				closeBoth("")
+				return errorReason(readErr, forcedReason())
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		result.VisitorReason = copyHalf(backend, visitor, &result.VisitorBytes)
+	}()
+
+	go func() {
+		defer wg.Done()
+		result.BackendReason = copyHalf(visitor, backend, &result.BackendBytes)
+	}()
+
+	wg.Wait()
+	close(done)
+
+	return result
+}
+
+func errorReason(err error, forced string) string {
+	if forced != "" {
+		return forced
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		return "closed"
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,150 @@
+package pinge
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a tcp connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("cannot accept connection")
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+
+	return conn, peer
+}
+
+// startPipe pipes a new visitor connection to a new backend connection and
+// returns the outer ends of both.
+func startPipe(t *testing.T, idleTimeout time.Duration, maxLifetime time.Duration) (net.Conn, net.Conn, chan pipeResult) {
+	visitor, visitorEnd := tcpPair(t)
+	backend, backendEnd := tcpPair(t)
+
+	results := make(chan pipeResult, 1)
+
+	go func() {
+		results <- pipe(visitorEnd, backend, idleTimeout, maxLifetime)
+	}()
+
+	return visitor, backendEnd, results
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	visitor, backend, results := startPipe(t, 0, 0)
+
+	visitor.Write([]byte("request"))
+	visitor.(*net.TCPConn).CloseWrite()
+
+	// the backend sees the end of the request and still answers
+	b, err := io.ReadAll(backend)
+	if err != nil || string(b) != "request" {
+		t.Fatalf("backend got %q, %v", b, err)
+	}
+
+	backend.Write([]byte("response"))
+	backend.Close()
+
+	b, err = io.ReadAll(visitor)
+	if err != nil || string(b) != "response" {
+		t.Fatalf("visitor got %q, %v", b, err)
+	}
+
+	result := <-results
+	want := pipeResult{VisitorBytes: 7, VisitorReason: closeReasonEOF, BackendBytes: 8, BackendReason: closeReasonEOF}
+
+	if result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	visitor, backend, results := startPipe(t, 200*time.Millisecond, 0)
+
+	// traffic keeps the connection open past the timeout
+	for i := 0; i < 5; i++ {
+		visitor.Write([]byte("x"))
+
+		if _, err := io.ReadFull(backend, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+	case result := <-results:
+		t.Fatalf("active connection closed with %+v", result)
+	default:
+	}
+
+	select {
+	case result := <-results:
+		if result.VisitorReason != closeReasonIdle || result.BackendReason != closeReasonIdle || result.VisitorBytes != 5 {
+			t.Fatalf("got %+v, want idle timeout", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection is not closed")
+	}
+
+	if _, err := visitor.Read(make([]byte, 1)); err == nil {
+		t.Fatal("visitor connection is open")
+	}
+}
+
+func TestPipeMaxLifetime(t *testing.T) {
+	visitor, backend, results := startPipe(t, time.Minute, 300*time.Millisecond)
+
+	start := time.Now()
+
+	go func() {
+		for {
+			if _, err := visitor.Write([]byte("x")); err != nil {
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	go io.Copy(io.Discard, backend)
+
+	select {
+	case result := <-results:
+		if result.VisitorReason != closeReasonMaxLifetime || result.BackendReason != closeReasonMaxLifetime {
+			t.Fatalf("got %+v, want max lifetime", result)
+		}
+
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Fatalf("connection closed after %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection outlived its max lifetime")
+	}
+}
@@ -3,18 +3,73 @@ package pinge
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
-
-	"golang.org/x/sync/errgroup"
+	"net/http"
 )
 
 func InitService(ctx context.Context, serviceName string, token string, host string, port string, options []ClientOption) error {
+	return InitServiceTarget(ctx, serviceName, token, net.JoinHostPort(host, port), options)
+}
+
+// InitServiceTarget exposes the local backend described by the target, see
+// ParseTarget. The target is ignored when the options contain WithBalancer.
+func InitServiceTarget(ctx context.Context, serviceName string, token string, target string, options []ClientOption) error {
+	if !hasBalancer(options) {
+		if _, err := ParseTarget(target); err != nil {
+			return err
+		}
+	}
+
 	client, err := InitClient(ctx, serviceName, token, options...)
 	if err != nil {
 		return err
 	}
 
+	return serveTarget(ctx, client, target)
+}
+
+// hasBalancer reports whether the options contain WithBalancer.
+func hasBalancer(options []ClientOption) bool {
+	var c Client
+	for _, option := range options {
+		option(&c)
+	}
+
+	return c.balancerOptions != nil
+}
+
+// serveTarget proxies the connections of the client to the target, or to the
+// backends of its balancer.
+func serveTarget(ctx context.Context, client *Client, target string) error {
+	if client.auth != nil && client.auth.hasCredentials() && client.httpOptions == nil {
+		client.Close()
+		return fmt.Errorf("basic auth, bearer tokens and signed urls require http mode")
+	}
+
+	if client.balancer == nil {
+		balancer, err := newBalancer(BalancerOptions{
+			Backends: []string{target},
+		})
+		if err != nil {
+			client.Close()
+			return err
+		}
+
+		client.mu.Lock()
+		client.balancer = balancer
+		client.mu.Unlock()
+	}
+
+	client.balancer.runHealthChecks(client.ctx)
+
+	target = client.balancer.backends[0].address
+
+	if client.httpOptions != nil {
+		handler := client.wrapHandler(target, newHTTPProxy(client.balancer, *client.httpOptions))
+
+		return serveHTTP(ctx, client, handler)
+	}
+
 	for {
 		conn, err := client.Accept()
 		if err != nil {
@@ -24,33 +79,43 @@ func InitService(ctx context.Context, serviceName string, token string, host str
 		handler := func() error {
 			defer conn.Close()
 
-			localConn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+			localConn, err := client.balancer.dial(client.ctx)
 			if err != nil {
 				return err
 			}
 
 			defer localConn.Close()
 
-			g := errgroup.Group{}
-
-			g.Go(func() error {
-				io.Copy(conn, localConn)
-				conn.Close()
-				return nil
-			})
+			result := pipe(conn, localConn, client.idleTimeout, client.maxLifetime)
 
-			g.Go(func() error {
-				io.Copy(localConn, conn)
-				return nil
-			})
+			fmt.Printf("connection closed %s, visitor: %s after %d bytes, backend: %s after %d bytes\r\n",
+				target, result.VisitorReason, result.VisitorBytes, result.BackendReason, result.BackendBytes)
 
-			return g.Wait()
+			return nil
 		}
 
 		go func() {
 			if err := handler(); err != nil {
-				fmt.Println("close connection with error", host, port, err)
+				fmt.Println("close connection with error", target, err)
 			}
 		}()
 	}
 }
+
+// wrapHandler applies the access control and the inspector of the client to
+// the handler serving the tunnel.
+func (c *Client) wrapHandler(target string, handler http.Handler) http.Handler {
+	if c.inspector != nil {
+		c.inspector.addReplayHandler(c.ctx, c.serviceName, handler)
+	}
+
+	if c.auth != nil {
+		handler = c.auth.middleware(c, handler)
+	}
+
+	if c.inspector != nil {
+		handler = c.inspector.Middleware(c.serviceName, target, handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,70 @@
+package pinge
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestProxyConcurrentConnections(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	go InitServiceTarget(ctx, "echo", "token", newEchoServer(t), []ClientOption{
+		WithTopologyAddress(topology.URL()),
+	})
+
+	if err := gate.WaitConnected(ctx, "echo", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(seed int64) {
+			defer wg.Done()
+
+			data := make([]byte, 256<<10)
+			rand.New(rand.NewSource(seed)).Read(data)
+
+			conn, err := gate.Dial(ctx, "echo")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			go func() {
+				conn.Write(data)
+				conn.(interface{ CloseWrite() error }).CloseWrite()
+			}()
+
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if !bytes.Equal(got, data) {
+				errs <- fmt.Errorf("connection %d got %d bytes back, want the %d sent", seed, len(got), len(data))
+			}
+		}(int64(i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
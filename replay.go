@@ -0,0 +1,323 @@
+package pinge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrorCaptureNotFound = errors.New("capture not found")
+
+type Replay struct {
+	StartedAt time.Time         `json:"started_at"`
+	Duration  time.Duration     `json:"duration"`
+	Edit      ReplayEdit        `json:"edit"`
+	Response  *CapturedResponse `json:"response,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// ReplayEdit changes the recorded request before it is sent again. Redacted
+// headers are replayed with their original values, except for captures
+// loaded from disk which do not keep them, unless they are set here.
+type ReplayEdit struct {
+	Header        map[string]string `json:"header,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Body          *string           `json:"body,omitempty"`
+}
+
+// replayHandler is the handler of a running tunnel, without access control
+// and inspection.
+type replayHandler struct {
+	http.Handler
+}
+
+// addReplayHandler replays the captures of the service with the handler
+// until the context is done, so that replays go through the same proxy
+// settings as the original requests.
+func (i *Inspector) addReplayHandler(ctx context.Context, service string, handler http.Handler) {
+	h := &replayHandler{Handler: handler}
+
+	i.mu.Lock()
+	i.handlers[service] = h
+	i.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		i.mu.Lock()
+		if i.handlers[service] == h {
+			delete(i.handlers, service)
+		}
+		i.mu.Unlock()
+	}()
+}
+
+// Replay sends the recorded request again through the handler of its
+// tunnel and records the new response next to the original one. The tunnel
+// must be running.
+func (i *Inspector) Replay(id string, edit ReplayEdit) (*Replay, error) {
+	capture, ok := i.Entry(id)
+	if !ok {
+		return nil, ErrorCaptureNotFound
+	}
+
+	i.mu.RLock()
+	handler, ok := i.handlers[capture.Service]
+	i.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("cannot replay capture %s: tunnel %s is not running", id, capture.Service)
+	}
+
+	req, err := i.replayRequest(capture, edit)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	replay := &Replay{
+		StartedAt: time.Now(),
+		Edit:      edit,
+	}
+
+	w := &replayWriter{
+		header: make(http.Header),
+		body:   &limitedBuffer{limit: i.options.MaxBodySize},
+	}
+
+	handler.ServeHTTP(w, req.WithContext(ctx))
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	replay.Duration = time.Since(replay.StartedAt)
+	replay.Response = &CapturedResponse{
+		StatusCode:    w.status,
+		Header:        i.redact(w.header),
+		Body:          w.body.buf,
+		BodyTruncated: w.body.truncated,
+	}
+
+	save := func() {}
+
+	i.mu.Lock()
+	for _, entry := range i.entries {
+		if entry != nil && entry.ID == id {
+			entry.Replays = append(entry.Replays, replay)
+			save = i.encodeFile(entry)
+			break
+		}
+	}
+	i.mu.Unlock()
+
+	save()
+
+	return replay, nil
+}
+
+// replayWriter records the response of a replayed request.
+type replayWriter struct {
+	header http.Header
+	status int
+	body   *limitedBuffer
+}
+
+func (w *replayWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *replayWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(p)
+}
+
+func (i *Inspector) replayRequest(capture *Capture, edit ReplayEdit) (*http.Request, error) {
+	body := capture.Request.Body
+
+	if edit.Body != nil {
+		body = []byte(*edit.Body)
+	} else if capture.Request.BodyTruncated {
+		return nil, fmt.Errorf("body of capture %s was truncated, pass a body to replay it", capture.ID)
+	}
+
+	public, err := url.Parse(capture.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	local := url.URL{
+		Scheme:   "http",
+		Host:     public.Host,
+		Path:     public.Path,
+		RawPath:  public.RawPath,
+		RawQuery: public.RawQuery,
+	}
+
+	req, err := http.NewRequest(capture.Request.Method, local.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range capture.Request.Header {
+		for _, value := range values {
+			if value == redactedValue {
+				continue
+			}
+
+			req.Header.Add(name, value)
+		}
+	}
+
+	for name, values := range capture.redactedHeader {
+		req.Header[name] = append([]string{}, values...)
+	}
+
+	for _, name := range edit.RemoveHeaders {
+		req.Header.Del(name)
+	}
+
+	for name, value := range edit.Header {
+		req.Header.Set(name, value)
+	}
+
+	req.Header.Del("Content-Length")
+	req.ContentLength = int64(len(body))
+
+	return req, nil
+}
+
+func (i *Inspector) load() error {
+	if err := os.MkdirAll(i.options.Dir, 0700); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(i.options.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var captures []*Capture
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var capture Capture
+
+		if err := json.Unmarshal(b, &capture); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		captures = append(captures, &capture)
+	}
+
+	sort.Slice(captures, func(a, b int) bool {
+		return captureNumber(captures[a]) < captureNumber(captures[b])
+	})
+
+	for _, capture := range captures {
+		if n := captureNumber(capture); n > i.lastID {
+			i.lastID = n
+		}
+
+		capture.file = &captureFile{}
+
+		if old := i.entries[i.next]; old != nil {
+			i.removeFile(old)
+		}
+
+		i.entries[i.next] = capture
+		i.next = (i.next + 1) % len(i.entries)
+	}
+
+	return nil
+}
+
+// captureFile orders the writes of the file of a capture, which happen
+// outside of the inspector lock.
+type captureFile struct {
+	mu      sync.Mutex
+	saved   uint64
+	removed bool
+}
+
+// encodeFile encodes the capture while the caller holds the lock and returns
+// the function writing it, to be called without the lock.
+func (i *Inspector) encodeFile(capture *Capture) func() {
+	if i.options.Dir == "" {
+		return func() {}
+	}
+
+	capture.version++
+	version := capture.version
+
+	b, err := json.Marshal(capture)
+	if err != nil {
+		fmt.Println("cannot encode capture", capture.ID, err)
+		return func() {}
+	}
+
+	return func() {
+		file := capture.file
+
+		file.mu.Lock()
+		defer file.mu.Unlock()
+
+		// a newer version is written already or the capture is gone
+		if file.removed || file.saved >= version {
+			return
+		}
+
+		if err := os.WriteFile(i.capturePath(capture), b, 0600); err != nil {
+			fmt.Println("cannot save capture", capture.ID, err)
+			return
+		}
+
+		file.saved = version
+	}
+}
+
+func (i *Inspector) removeFile(capture *Capture) {
+	if i.options.Dir == "" {
+		return
+	}
+
+	capture.file.mu.Lock()
+	defer capture.file.mu.Unlock()
+
+	capture.file.removed = true
+	os.Remove(i.capturePath(capture))
+}
+
+func (i *Inspector) capturePath(capture *Capture) string {
+	return filepath.Join(i.options.Dir, capture.ID+".json")
+}
+
+func captureNumber(capture *Capture) uint64 {
+	n, _ := strconv.ParseUint(capture.ID, 10, 64)
+	return n
+}
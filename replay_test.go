@@ -0,0 +1,211 @@
+package pinge
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// waitCapture waits until the inspector recorded n captures and returns the
+// newest one.
+func waitCapture(t *testing.T, inspector *Inspector, n int) *Capture {
+	t.Helper()
+
+	var entries []*Capture
+	waitFor(t, func() bool {
+		entries = inspector.Entries()
+		return len(entries) >= n
+	}, "%d captures", n)
+
+	return entries[0]
+}
+
+func TestReplay(t *testing.T) {
+	gate := newTestGate(t)
+
+	// the backend wants the token, the host set by the tunnel and the header
+	// added by it
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.Host + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Tunnel") + " " + r.Header.Get("X-Debug") + " " + string(b)))
+	})
+
+	dir := t.TempDir()
+
+	inspector := newInspectedService(t, gate, "web", backend,
+		InspectorOptions{RedactHeaders: []string{"Authorization"}, Dir: dir},
+		WithHTTP(HTTPOptions{RewriteHost: true, RequestHeaders: map[string]string{"X-Tunnel": "1"}}),
+	)
+
+	req, _ := http.NewRequest("POST", "http://"+gate.URI("web")+"/path?q=1", strings.NewReader("body"))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	res, err := gate.HTTPClient("web").Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	capture := waitCapture(t, inspector, 1)
+
+	replay, err := inspector.Replay(capture.ID, ReplayEdit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replay.Response.StatusCode != http.StatusOK || string(replay.Response.Body) != string(original) {
+		t.Fatalf("replay got %d %q, want the original %q", replay.Response.StatusCode, replay.Response.Body, original)
+	}
+
+	body := "edited"
+	replay, err = inspector.Replay(capture.ID, ReplayEdit{
+		Header: map[string]string{"X-Debug": "1"},
+		Body:   &body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(replay.Response.Body); !strings.HasSuffix(got, " 1 1 edited") {
+		t.Fatalf("edited replay got %q", got)
+	}
+
+	replay, err = inspector.Replay(capture.ID, ReplayEdit{RemoveHeaders: []string{"Authorization"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replay.Response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("replay without the token got %d", replay.Response.StatusCode)
+	}
+
+	entry, _ := inspector.Entry(capture.ID)
+	if len(entry.Replays) != 3 {
+		t.Fatalf("got %d replays, want 3", len(entry.Replays))
+	}
+
+	if _, err := inspector.Replay("missing", ReplayEdit{}); err != ErrorCaptureNotFound {
+		t.Fatalf("got %v for a missing capture", err)
+	}
+
+	// the redacted value stays in memory
+	b, err := os.ReadFile(filepath.Join(dir, capture.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "secret") {
+		t.Fatal("redacted header is saved")
+	}
+
+	// the captures survive a restart, with their replays
+	loaded, err := NewInspector(InspectorOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := loaded.Entry(capture.ID)
+	if !ok || len(entry.Replays) != 3 || entry.Request.URL != capture.Request.URL {
+		t.Fatalf("unexpected loaded capture %+v", entry)
+	}
+
+	// without its tunnel the capture cannot be replayed
+	if _, err := loaded.Replay(capture.ID, ReplayEdit{}); err == nil {
+		t.Fatal("capture of a stopped tunnel is replayed")
+	}
+}
+
+func TestReplayTruncatedBody(t *testing.T) {
+	gate := newTestGate(t)
+	inspector := newInspectedService(t, gate, "web", http.HandlerFunc(echoBodyHandler), InspectorOptions{MaxBodySize: 2})
+
+	res, err := gate.HTTPClient("web").Post("http://"+gate.URI("web")+"/", "text/plain", strings.NewReader("long body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	capture := waitCapture(t, inspector, 1)
+
+	if _, err := inspector.Replay(capture.ID, ReplayEdit{}); err == nil {
+		t.Fatal("truncated body is replayed")
+	}
+
+	body := "new"
+	replay, err := inspector.Replay(capture.ID, ReplayEdit{Body: &body})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replay.Response.StatusCode != http.StatusCreated || string(replay.Response.Body) != "ne" {
+		t.Fatalf("unexpected replay %+v", replay.Response)
+	}
+}
+
+func TestReplayAPI(t *testing.T) {
+	gate := newTestGate(t)
+	inspector := newInspectedService(t, gate, "web", http.HandlerFunc(echoBodyHandler), InspectorOptions{})
+
+	res, err := gate.HTTPClient("web").Post("http://"+gate.URI("web")+"/", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	capture := waitCapture(t, inspector, 1)
+
+	admin := httptest.NewServer(NewAdminHandler(NewRegistry(), inspector))
+	t.Cleanup(admin.Close)
+
+	url := admin.URL + "/inspect/api/requests/" + capture.ID + "/replay"
+
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		status      int
+	}{
+		{name: "form of another site", contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		{name: "script of another site", contentType: "application/json", origin: "https://evil.example", status: http.StatusForbidden},
+		{name: "inspector page", contentType: "application/json", origin: admin.URL, status: http.StatusOK},
+		{name: "cli", contentType: "application/json; charset=utf-8", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", url, strings.NewReader("{}"))
+		req.Header.Set("Content-Type", test.contentType)
+
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Fatalf("%s: got status %d, want %d", test.name, res.StatusCode, test.status)
+		}
+	}
+
+	entry, _ := inspector.Entry(capture.ID)
+	if len(entry.Replays) != 2 {
+		t.Fatalf("got %d replays, want 2", len(entry.Replays))
+	}
+}
@@ -0,0 +1,198 @@
+package pinge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pinge-link/sdk/spec"
+
+	"google.golang.org/grpc"
+)
+
+const topologyDefault = "http://topology.pinge.dev:5004"
+
+// Session fetches the topology and selects a region once, and shares the
+// result together with the grpc connections to the gates between every
+// client started with WithSession.
+type Session struct {
+	topologyAddress string
+	topology        *TopologyConfig
+	region          *TopologyRegion
+	probes          []TopologyProbe
+	timings         SessionTimings
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewSession(ctx context.Context, topologyAddress string) (*Session, error) {
+	if topologyAddress == "" {
+		topologyAddress = topologyDefault
+	}
+
+	s := Session{
+		topologyAddress: topologyAddress,
+		conns:           make(map[string]*grpc.ClientConn),
+	}
+
+	startTime := time.Now()
+
+	topology, err := s.getTopology()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get topology: %w", err)
+	}
+
+	s.timings.Topology = time.Since(startTime)
+	startTime = time.Now()
+
+	region, err := s.selectRegion(topology)
+	if err != nil {
+		return nil, err
+	}
+
+	s.timings.SelectRegion = time.Since(startTime)
+
+	s.topology = topology
+	s.region = region
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	return &s, nil
+}
+
+type SessionTimings struct {
+	Topology     time.Duration `json:"topology"`
+	SelectRegion time.Duration `json:"select_region"`
+}
+
+func (s *Session) Probes() []TopologyProbe {
+	return s.probes
+}
+
+func (s *Session) Region() string {
+	return s.region.Id
+}
+
+func (s *Session) Timings() SessionTimings {
+	return s.timings
+}
+
+func (s *Session) getTopology() (*TopologyConfig, error) {
+	res, err := http.Get(s.topologyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var cfg TopologyConfig
+
+	if err := json.NewDecoder(res.Body).Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func (s *Session) selectRegion(topology *TopologyConfig) (*TopologyRegion, error) {
+	var bestRegion *TopologyRegion
+	var bestPingTime time.Duration
+
+	for i, region := range topology.Regions {
+		opts := []grpc.DialOption{
+			grpc.WithInsecure(),
+		}
+
+		probe := TopologyProbe{
+			Region:   region.Id,
+			PingHost: region.PingHost,
+		}
+
+		conn, err := grpc.Dial(region.PingHost, opts...)
+		if err != nil {
+			fmt.Printf("host %s for region %s, not available: %s\r\n", region.Id, region.PingHost, err)
+			probe.Error = err.Error()
+			s.probes = append(s.probes, probe)
+			continue
+		}
+
+		pingerClient := spec.NewServiceClient(conn)
+
+		startTime := time.Now()
+
+		if _, err := pingerClient.Ping(context.Background(), &spec.PingRequestResponse{}); err != nil {
+			fmt.Printf("host %s for region %s, not available: %s\r\n", region.Id, region.PingHost, err)
+			conn.Close()
+			probe.Error = err.Error()
+			s.probes = append(s.probes, probe)
+			continue
+		}
+
+		execTime := time.Since(startTime)
+		conn.Close()
+
+		probe.RTT = execTime
+		s.probes = append(s.probes, probe)
+
+		if bestRegion == nil {
+			bestRegion = &topology.Regions[i]
+			bestPingTime = execTime
+		} else if execTime < bestPingTime {
+			bestRegion = &topology.Regions[i]
+			bestPingTime = execTime
+		}
+	}
+
+	if bestRegion == nil {
+		return nil, fmt.Errorf("cannot find available gates")
+	}
+
+	if len(bestRegion.Gates) == 0 {
+		return nil, fmt.Errorf("region %s has no gates", bestRegion.Id)
+	}
+
+	return bestRegion, nil
+}
+
+// dial returns a grpc connection to the gate, reusing the one opened by an
+// earlier client of the session.
+func (s *Session) dial(host string) (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if conn, ok := s.conns[host]; ok {
+		return conn, nil
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+	}
+
+	conn, err := grpc.Dial(host, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.conns[host] = conn
+
+	return conn, nil
+}
+
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for host, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, host)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package pinge
+
+import (
+	"compress/gzip"
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type DirOptions struct {
+	// Listing shows the content of directories without index.html.
+	Listing bool `json:"listing,omitempty"`
+	// SPA serves index.html for paths which do not exist, so that client
+	// side routing of single page applications works.
+	SPA  bool `json:"spa,omitempty"`
+	Gzip bool `json:"gzip,omitempty"`
+}
+
+// ServeHandler serves the handler directly on the tunnel, without any local
+// port. Access control and the inspector of the client apply to it.
+func ServeHandler(ctx context.Context, client *Client, handler http.Handler) error {
+	return serveHTTP(ctx, client, client.wrapHandler("handler://"+client.serviceName, handler))
+}
+
+// NewDirHandler serves the files of the directory. Range requests are
+// supported by http.FileServer.
+func NewDirHandler(dir string, options DirOptions) http.Handler {
+	root := http.Dir(dir)
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		fullName := filepath.Join(dir, filepath.FromSlash(name))
+
+		info, err := os.Stat(fullName)
+		if os.IsNotExist(err) && options.SPA {
+			http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+			return
+		}
+
+		if err == nil && info.IsDir() && !options.Listing {
+			if _, err := os.Stat(filepath.Join(fullName, "index.html")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		http.FileServer(root).ServeHTTP(w, r)
+	})
+
+	if options.Gzip {
+		handler = gzipHandler(handler)
+	}
+
+	return handler
+}
+
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter compresses the response when it is a full 200 response
+// of a compressible type.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	header := w.Header()
+	if status == http.StatusOK && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+
+	return nil
+}
+
+func compressible(contentType string) bool {
+	for _, prefix := range []string{"text/", "application/javascript", "application/json", "application/xml", "image/svg+xml", "application/wasm"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
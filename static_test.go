@@ -0,0 +1,155 @@
+package pinge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestServeHandlerReplay(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	inspector, err := NewInspector(InspectorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := InitClient(ctx, "web", "token", WithTopologyAddress(topology.URL()), WithInspector(inspector))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	go ServeHandler(ctx, client, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := gate.HTTPClient("web").Get("http://" + gate.URI("web") + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	capture := waitCapture(t, inspector, 1)
+
+	// the handler has no address, the replay goes to it in the process
+	replay, err := inspector.Replay(capture.ID, ReplayEdit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replay.Response.StatusCode != http.StatusOK || string(replay.Response.Body) != "/page" {
+		t.Fatalf("unexpected replay %+v", replay.Response)
+	}
+}
+
+func TestDirHandler(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "site")
+
+	// the file next to the directory is not served
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"index.html":      "<html>index</html>",
+		"app.js":          strings.Repeat("console.log(1);\n", 100),
+		"docs/readme.txt": "readme",
+	}
+
+	for name, content := range files {
+		fullName := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fullName), 0o755)
+
+		if err := os.WriteFile(fullName, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options DirOptions
+		path    string
+		header  map[string]string
+		status  int
+		body    string
+		gzip    bool
+	}{
+		{name: "file", path: "/app.js", status: http.StatusOK, body: files["app.js"]},
+		{name: "index", path: "/", status: http.StatusOK, body: files["index.html"]},
+		{name: "missing", path: "/missing", status: http.StatusNotFound},
+		{name: "spa", options: DirOptions{SPA: true}, path: "/route/1", status: http.StatusOK, body: files["index.html"]},
+		{name: "no listing", path: "/docs/", status: http.StatusNotFound},
+		{name: "listing", options: DirOptions{Listing: true}, path: "/docs/", status: http.StatusOK, body: "readme.txt"},
+		{name: "escape", path: "/../secret.txt", status: http.StatusNotFound},
+		{
+			name:    "gzip",
+			options: DirOptions{Gzip: true},
+			path:    "/app.js",
+			header:  map[string]string{"Accept-Encoding": "gzip"},
+			status:  http.StatusOK,
+			body:    files["app.js"],
+			gzip:    true,
+		},
+		{
+			name:    "range",
+			options: DirOptions{Gzip: true},
+			path:    "/docs/readme.txt",
+			header:  map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"},
+			status:  http.StatusPartialContent,
+			body:    "read",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.path, nil)
+			for key, value := range test.header {
+				req.Header.Set(key, value)
+			}
+
+			rec := httptest.NewRecorder()
+			NewDirHandler(dir, test.options).ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d", rec.Code, test.status)
+			}
+
+			if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != test.gzip {
+				t.Fatalf("got gzip %v, want %v", gzipped, test.gzip)
+			}
+
+			body := rec.Body.Bytes()
+			if test.gzip {
+				r, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				body, _ = io.ReadAll(r)
+			}
+
+			if !strings.Contains(string(body), test.body) {
+				t.Fatalf("got body %q, want %q", body, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package pinge
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ClientStatus struct {
+	Service        string           `json:"service"`
+	URI            string           `json:"uri"`
+	Region         string           `json:"region"`
+	Gate           string           `json:"gate"`
+	ConnectedSince time.Time        `json:"connected_since"`
+	Reconnects     int              `json:"reconnects"`
+	Rejected       map[string]int64 `json:"rejected,omitempty"`
+	Backends       []BackendStatus  `json:"backends,omitempty"`
+}
+
+// ConnectionInfo describes a proxied connection. GateAddr is the address of
+// the gate end of the connection, the gate does not tell the visitor address.
+type ConnectionInfo struct {
+	Service  string        `json:"service"`
+	GateAddr string        `json:"gate_addr"`
+	Age      time.Duration `json:"age"`
+	BytesIn  int64         `json:"bytes_in"`
+	BytesOut int64         `json:"bytes_out"`
+}
+
+type TopologyStatus struct {
+	Service string                `json:"service"`
+	Regions []TopologyRegionState `json:"regions"`
+	Probes  []TopologyProbe       `json:"probes"`
+}
+
+type TopologyRegionState struct {
+	Id       string              `json:"id"`
+	PingHost string              `json:"ping_host"`
+	Selected bool                `json:"selected"`
+	Gates    []TopologyGateState `json:"gates"`
+}
+
+type TopologyGateState struct {
+	SecondaryAddress string `json:"secondary_address"`
+	PrimaryAddress   string `json:"primary_address"`
+	Busy             bool   `json:"busy"`
+}
+
+func (c *Client) Status() ClientStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var region string
+	if c.region != nil {
+		region = c.region.Id
+	}
+
+	status := ClientStatus{
+		Service:        c.serviceName,
+		URI:            c.uri,
+		Region:         region,
+		Gate:           c.initHost,
+		ConnectedSince: c.connectedSince,
+		Reconnects:     c.reconnects,
+		Rejected:       make(map[string]int64, len(c.rejected)),
+	}
+
+	for reason, n := range c.rejected {
+		status.Rejected[reason] = n
+	}
+
+	if c.balancer != nil {
+		status.Backends = c.balancer.status()
+	}
+
+	return status
+}
+
+func (c *Client) Connections() []ConnectionInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	infos := make([]ConnectionInfo, 0, len(c.conns))
+
+	for conn := range c.conns {
+		infos = append(infos, ConnectionInfo{
+			Service:  c.serviceName,
+			GateAddr: conn.gateAddr,
+			Age:      time.Since(conn.startedAt),
+			BytesIn:  atomic.LoadInt64(&conn.bytesIn),
+			BytesOut: atomic.LoadInt64(&conn.bytesOut),
+		})
+	}
+
+	return infos
+}
+
+func (c *Client) Topology() TopologyStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := TopologyStatus{
+		Service: c.serviceName,
+		Probes:  c.session.probes,
+	}
+
+	for _, region := range c.session.topology.Regions {
+		state := TopologyRegionState{
+			Id:       region.Id,
+			PingHost: region.PingHost,
+		}
+
+		gates := region.Gates
+		if c.region != nil && c.region.Id == region.Id {
+			state.Selected = true
+			gates = c.region.Gates
+		}
+
+		for _, gate := range gates {
+			state.Gates = append(state.Gates, TopologyGateState{
+				SecondaryAddress: gate.SecondaryAddress,
+				PrimaryAddress:   gate.PrimaryAddress,
+				Busy:             gate.Busy,
+			})
+		}
+
+		status.Regions = append(status.Regions, state)
+	}
+
+	return status
+}
+
+func (c *Client) trackConn(conn net.Conn) *trackedConn {
+	tc := &trackedConn{
+		Conn:      conn,
+		client:    c,
+		gateAddr:  conn.RemoteAddr().String(),
+		startedAt: time.Now(),
+	}
+
+	c.mu.Lock()
+	c.conns[tc] = struct{}{}
+	c.mu.Unlock()
+
+	return tc
+}
+
+func (c *Client) untrackConn(tc *trackedConn) {
+	c.mu.Lock()
+	delete(c.conns, tc)
+	c.mu.Unlock()
+}
+
+// trackedConn counts bytes read from the visitor (in) and written back to
+// the visitor (out). It is listed by the admin api until it is closed.
+type trackedConn struct {
+	bytesIn  int64
+	bytesOut int64
+
+	net.Conn
+	client    *Client
+	gateAddr  string
+	startedAt time.Time
+	closeOnce sync.Once
+}
+
+func (t *trackedConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	atomic.AddInt64(&t.bytesIn, int64(n))
+	return n, err
+}
+
+func (t *trackedConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	atomic.AddInt64(&t.bytesOut, int64(n))
+	return n, err
+}
+
+func (t *trackedConn) CloseWrite() error {
+	if cw, ok := t.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return t.Close()
+}
+
+func (t *trackedConn) Close() error {
+	t.closeOnce.Do(func() {
+		t.client.untrackConn(t)
+	})
+
+	return t.Conn.Close()
+}
+
+// Registry keeps track of every client started by the agent, so that the
+// admin api can list all of them in docker mode.
+type Registry struct {
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		clients: make(map[*Client]struct{}),
+	}
+}
+
+func (r *Registry) Clients() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(r.clients))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].serviceName < clients[j].serviceName
+	})
+
+	return clients
+}
+
+func (r *Registry) add(c *Client) {
+	r.mu.Lock()
+	r.clients[c] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *Registry) remove(c *Client) {
+	r.mu.Lock()
+	delete(r.clients, c)
+	r.mu.Unlock()
+}
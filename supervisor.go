@@ -0,0 +1,424 @@
+package pinge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+var ErrorSupervisorStopped = errors.New("command stopped")
+
+// SupervisorOptions describe the command run next to the tunnel.
+type SupervisorOptions struct {
+	Args []string
+
+	// Restart is RestartNo, RestartOnFailure or RestartAlways, MaxRestarts
+	// limits the restarts when positive.
+	Restart      string
+	MaxRestarts  int
+	RestartDelay time.Duration
+
+	// ReadyTarget, in the format of ParseTarget, is ready when it accepts
+	// connections, or with ReadyPath when GET of the path answers 2xx. The
+	// command is ready as soon as it starts without ReadyTarget.
+	ReadyTarget   string
+	ReadyPath     string
+	ReadyInterval time.Duration
+
+	// StopTimeout is how long the command may take to exit after a signal
+	// before it is killed.
+	StopTimeout time.Duration
+}
+
+// Supervisor runs a command, restarts it by the policy and tells when it is
+// ready to serve the tunnel.
+type Supervisor struct {
+	options SupervisorOptions
+	ready   *Target
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	readyCh  chan struct{}
+	stopping bool
+	restarts int
+}
+
+func NewSupervisor(options SupervisorOptions) (*Supervisor, error) {
+	if len(options.Args) == 0 {
+		return nil, fmt.Errorf("command is empty")
+	}
+
+	switch options.Restart {
+	case "":
+		options.Restart = RestartNo
+	case RestartNo, RestartOnFailure, RestartAlways:
+	default:
+		return nil, fmt.Errorf("unknown restart policy %q", options.Restart)
+	}
+
+	if options.RestartDelay <= 0 {
+		options.RestartDelay = time.Second
+	}
+
+	if options.ReadyInterval <= 0 {
+		options.ReadyInterval = 250 * time.Millisecond
+	}
+
+	if options.StopTimeout <= 0 {
+		options.StopTimeout = 10 * time.Second
+	}
+
+	s := Supervisor{
+		options: options,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		readyCh: make(chan struct{}),
+	}
+
+	if options.ReadyTarget != "" {
+		target, err := ParseTarget(options.ReadyTarget)
+		if err != nil {
+			return nil, err
+		}
+
+		s.ready = target
+	}
+
+	return &s, nil
+}
+
+// Run runs the command until it exits for good and returns its exit code.
+// The command gets SIGTERM when the context is done.
+func (s *Supervisor) Run(ctx context.Context) (int, error) {
+	defer close(s.done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Signal(syscall.SIGTERM)
+		case <-s.done:
+		}
+	}()
+
+	code := 0
+
+	for {
+		cmd := exec.Command(s.options.Args[0], s.options.Args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// the restart delay may end together with a stop, the command is
+		// not started again once stopping
+		s.mu.Lock()
+		if s.stopping {
+			s.mu.Unlock()
+			return code, nil
+		}
+
+		if err := cmd.Start(); err != nil {
+			s.mu.Unlock()
+			return 127, err
+		}
+
+		s.cmd = cmd
+		s.mu.Unlock()
+
+		exited := make(chan struct{})
+		go s.waitReady(exited)
+
+		err := cmd.Wait()
+		close(exited)
+
+		s.mu.Lock()
+		s.cmd = nil
+		s.setNotReady()
+		stopping := s.stopping
+		s.mu.Unlock()
+
+		code, err = exitCode(err)
+		if err != nil {
+			return code, err
+		}
+
+		if stopping || !s.restart(code) {
+			return code, nil
+		}
+
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+
+		fmt.Printf("command exited with code %d, restart in %s\r\n", code, s.options.RestartDelay)
+
+		select {
+		case <-time.After(s.options.RestartDelay):
+		case <-s.stopped:
+			return code, nil
+		}
+	}
+}
+
+func (s *Supervisor) restart(code int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.options.MaxRestarts > 0 && s.restarts >= s.options.MaxRestarts {
+		return false
+	}
+
+	switch s.options.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return code != 0
+	}
+
+	return false
+}
+
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 1, err
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+
+	return exitErr.ExitCode(), nil
+}
+
+// Signal forwards the signal to the command and stops the restarts, the
+// command is killed when it does not exit within StopTimeout.
+func (s *Supervisor) Signal(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopping {
+		s.stopping = true
+		close(s.stopped)
+		s.setNotReady()
+	}
+
+	cmd := s.cmd
+	if cmd == nil {
+		return
+	}
+
+	if err := cmd.Process.Signal(sig); err != nil {
+		cmd.Process.Kill()
+		return
+	}
+
+	time.AfterFunc(s.options.StopTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.cmd == cmd {
+			fmt.Println("command did not stop, kill it")
+			cmd.Process.Kill()
+		}
+	})
+}
+
+// Restarts returns how many times the command was restarted.
+func (s *Supervisor) Restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.restarts
+}
+
+// WaitReady waits until the running command is ready, it fails once the
+// command exits for good.
+func (s *Supervisor) WaitReady(ctx context.Context) error {
+	s.mu.Lock()
+	ready := s.readyCh
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-s.done:
+		return ErrorSupervisorStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitReady checks the command until it is ready or exits.
+func (s *Supervisor) waitReady(exited chan struct{}) {
+	ticker := time.NewTicker(s.options.ReadyInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.ready == nil || s.check(exited) {
+			break
+		}
+
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-exited:
+	case <-s.stopped:
+	case <-s.readyCh:
+	default:
+		fmt.Println("command is ready")
+		close(s.readyCh)
+	}
+}
+
+func (s *Supervisor) check(exited chan struct{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if s.options.ReadyPath == "" {
+		conn, err := s.ready.Dial(ctx)
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+
+		return true
+	}
+
+	httpc := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return s.ready.Dial(ctx)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.ready.Host()+s.options.ReadyPath, nil)
+	if err != nil {
+		return false
+	}
+
+	res, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+
+	res.Body.Close()
+
+	return res.StatusCode >= 200 && res.StatusCode < 300
+}
+
+// setNotReady makes WaitReady block again, the caller holds the lock.
+func (s *Supervisor) setNotReady() {
+	select {
+	case <-s.readyCh:
+		s.readyCh = make(chan struct{})
+	default:
+	}
+}
+
+// SplitCommand splits the command into words like a shell does, with single
+// and double quotes and backslash escapes. Variables and globs are not
+// expanded.
+func SplitCommand(command string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+
+	inWord := false
+	quote := rune(0)
+	escaped := false
+
+	for _, r := range command {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\"\\$`\n", r) {
+				word.WriteRune('\\')
+			}
+
+			// an escaped newline continues the line
+			if r != '\n' {
+				word.WriteRune(r)
+				inWord = true
+			}
+
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("command %q ends with a backslash", command)
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("command %q has an unterminated quote", command)
+	}
+
+	if inWord {
+		args = append(args, word.String())
+	}
+
+	return args, nil
+}
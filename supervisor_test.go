@@ -0,0 +1,246 @@
+package pinge
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+		err     bool
+	}{
+		{command: "npm run dev", args: []string{"npm", "run", "dev"}},
+		{command: "  sh  -c 'echo \"a b\"'  ", args: []string{"sh", "-c", `echo "a b"`}},
+		{command: `echo "a \"b\" \$c \d" it\'s`, args: []string{"echo", `a "b" $c \d`, "it's"}},
+		{command: `echo '' "" a\ b`, args: []string{"echo", "", "", "a b"}},
+		{command: "echo a\\\nb", args: []string{"echo", "ab"}},
+		{command: "a \\\n b", args: []string{"a", "b"}},
+		{command: "", args: nil},
+		{command: `echo "a`, err: true},
+		{command: `echo 'a`, err: true},
+		{command: `echo a\`, err: true},
+	}
+
+	for _, test := range tests {
+		args, err := SplitCommand(test.command)
+		if (err != nil) != test.err {
+			t.Fatalf("SplitCommand(%q) error %v", test.command, err)
+		}
+
+		if !test.err && !reflect.DeepEqual(args, test.args) {
+			t.Fatalf("SplitCommand(%q) = %q, want %q", test.command, args, test.args)
+		}
+	}
+}
+
+func TestSupervisorExitCode(t *testing.T) {
+	supervisor, err := NewSupervisor(SupervisorOptions{
+		Args: []string{"sh", "-c", "exit 3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := supervisor.Run(testContext(t))
+	if err != nil || code != 3 {
+		t.Fatalf("got code %d, %v, want 3", code, err)
+	}
+
+	if err := supervisor.WaitReady(testContext(t)); err != ErrorSupervisorStopped {
+		t.Fatalf("got %v after exit, want %v", err, ErrorSupervisorStopped)
+	}
+
+	if _, err := NewSupervisor(SupervisorOptions{Args: []string{"true"}, Restart: "sometimes"}); err == nil {
+		t.Fatal("unknown restart policy is accepted")
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "started")
+
+	supervisor, err := NewSupervisor(SupervisorOptions{
+		Args:         []string{"sh", "-c", `test -f "$0" || { touch "$0"; exit 1; }`, marker},
+		Restart:      RestartOnFailure,
+		RestartDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := supervisor.Run(testContext(t))
+	if err != nil || code != 0 || supervisor.Restarts() != 1 {
+		t.Fatalf("got code %d, %v after %d restarts, want 0 after 1", code, err, supervisor.Restarts())
+	}
+
+	supervisor, err = NewSupervisor(SupervisorOptions{
+		Args:         []string{"false"},
+		Restart:      RestartAlways,
+		MaxRestarts:  2,
+		RestartDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err = supervisor.Run(testContext(t))
+	if err != nil || code != 1 || supervisor.Restarts() != 2 {
+		t.Fatalf("got code %d, %v after %d restarts, want 1 after 2", code, err, supervisor.Restarts())
+	}
+}
+
+func TestSupervisorStopBeforeStart(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "started")
+
+	supervisor, err := NewSupervisor(SupervisorOptions{
+		Args:    []string{"sh", "-c", `touch "$0"; sleep 30`, marker},
+		Restart: RestartAlways,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stop between two runs, e.g. during the restart delay, is not lost
+	supervisor.Signal(syscall.SIGTERM)
+
+	start := time.Now()
+
+	code, err := supervisor.Run(testContext(t))
+	if err != nil || code != 0 || time.Since(start) > 5*time.Second {
+		t.Fatalf("got code %d, %v after %s", code, err, time.Since(start))
+	}
+
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatal("command is started after the stop")
+	}
+}
+
+func TestSupervisorReadyAndSignal(t *testing.T) {
+	var ready int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" || atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	supervisor, err := NewSupervisor(SupervisorOptions{
+		Args:          []string{"sleep", "30"},
+		Restart:       RestartAlways,
+		ReadyTarget:   server.Listener.Addr().String(),
+		ReadyPath:     "/ready",
+		ReadyInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		code int
+		err  error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		code, err := supervisor.Run(testContext(t))
+		done <- result{code, err}
+	}()
+
+	ctx, cancel := context.WithTimeout(testContext(t), 200*time.Millisecond)
+	defer cancel()
+
+	if err := supervisor.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("command is ready before the readiness path answers 2xx: %v", err)
+	}
+
+	atomic.StoreInt32(&ready, 1)
+
+	if err := supervisor.WaitReady(testContext(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	supervisor.Signal(syscall.SIGTERM)
+
+	res := <-done
+	if res.err != nil || res.code != 128+int(syscall.SIGTERM) {
+		t.Fatalf("got code %d, %v, want %d", res.code, res.err, 128+int(syscall.SIGTERM))
+	}
+
+	if supervisor.Restarts() != 0 {
+		t.Fatal("command is restarted after the signal")
+	}
+}
+
+func TestReadinessHoldsVisitors(t *testing.T) {
+	ctx := testContext(t)
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+	backend := newEchoServer(t)
+
+	ready := make(chan struct{})
+
+	go InitServiceTarget(ctx, "web", "token", backend, []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithReadiness(func(ctx context.Context) error {
+			select {
+			case <-ready:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}),
+	})
+
+	if err := gate.WaitConnected(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gate.Dial(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+
+	got := make(chan string, 1)
+
+	go func() {
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		got <- string(b)
+	}()
+
+	select {
+	case b := <-got:
+		t.Fatalf("got %q before the backend is ready", b)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(ready)
+
+	select {
+	case b := <-got:
+		if b != "ping" {
+			t.Fatalf("got %q, want ping", b)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
@@ -0,0 +1,166 @@
+package pinge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Target is the local backend of a tunnel. It is parsed from an url:
+//
+//	localhost:8080 or tcp://localhost:8080
+//	unix:///run/app.sock
+//	tls://localhost:8443?insecure=1&sni=app.local
+//	https://localhost:8443?ca=/etc/ca.pem&cert=/etc/client.pem&key=/etc/client.key
+//
+// An http target is a tcp target with port 80 by default, an https target is
+// a tls target with port 443 by default.
+type Target struct {
+	Network string
+	Address string
+	TLS     *tls.Config
+	raw     string
+}
+
+func ParseTarget(raw string) (*Target, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "tcp://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", raw, err)
+	}
+
+	t := Target{
+		Network: "tcp",
+		Address: u.Host,
+		raw:     raw,
+	}
+
+	switch u.Scheme {
+	case "tcp":
+	case "http":
+		if u.Port() == "" && u.Hostname() != "" {
+			t.Address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "unix":
+		t.Network = "unix"
+		t.Address = u.Path
+	case "tls", "https":
+		if u.Port() == "" && u.Scheme == "https" && u.Hostname() != "" {
+			t.Address = net.JoinHostPort(u.Hostname(), "443")
+		}
+
+		if t.TLS, err = targetTLSConfig(u); err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", raw, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid target %q: unknown scheme %s", raw, u.Scheme)
+	}
+
+	if t.Address == "" {
+		return nil, fmt.Errorf("invalid target %q: address is empty", raw)
+	}
+
+	if t.Network == "tcp" {
+		if _, _, err := net.SplitHostPort(t.Address); err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", raw, err)
+		}
+	}
+
+	return &t, nil
+}
+
+func targetTLSConfig(u *url.URL) (*tls.Config, error) {
+	query := u.Query()
+
+	cfg := tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: query.Get("insecure") == "1" || query.Get("insecure") == "true",
+	}
+
+	if sni := query.Get("sni"); sni != "" {
+		cfg.ServerName = sni
+	}
+
+	if ca := query.Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", ca)
+		}
+	}
+
+	cert, key := query.Get("cert"), query.Get("key")
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return &cfg, nil
+}
+
+func (t *Target) Dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, t.Network, t.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.TLS == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, t.TLS)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// Host is used as the Host header when requests are rewritten for the
+// target.
+func (t *Target) Host() string {
+	if t.Network == "unix" {
+		return "localhost"
+	}
+
+	if t.TLS != nil && t.TLS.ServerName != "" {
+		if _, port, err := net.SplitHostPort(t.Address); err == nil && port != "443" {
+			return net.JoinHostPort(t.TLS.ServerName, port)
+		}
+
+		return t.TLS.ServerName
+	}
+
+	return t.Address
+}
+
+func (t *Target) String() string {
+	return t.raw
+}
@@ -0,0 +1,167 @@
+package pinge
+
+import (
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pinge-link/sdk/pingetest"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		raw     string
+		network string
+		address string
+		tls     bool
+		host    string
+		err     bool
+	}{
+		{raw: "localhost:8080", network: "tcp", address: "localhost:8080", host: "localhost:8080"},
+		{raw: "tcp://127.0.0.1:80", network: "tcp", address: "127.0.0.1:80", host: "127.0.0.1:80"},
+		{raw: "http://[::1]:80", network: "tcp", address: "[::1]:80", host: "[::1]:80"},
+		{raw: "http://app.local", network: "tcp", address: "app.local:80", host: "app.local:80"},
+		{raw: "http://", err: true},
+		{raw: "unix:///run/app.sock", network: "unix", address: "/run/app.sock", host: "localhost"},
+		{raw: "tls://localhost:8443?insecure=1", network: "tcp", address: "localhost:8443", tls: true, host: "localhost:8443"},
+		{raw: "tls://127.0.0.1:8443?sni=app.local", network: "tcp", address: "127.0.0.1:8443", tls: true, host: "app.local:8443"},
+		{raw: "https://app.local", network: "tcp", address: "app.local:443", tls: true, host: "app.local"},
+		{raw: "ftp://localhost:21", err: true},
+		{raw: "localhost", err: true},
+		{raw: "unix://", err: true},
+		{raw: "tls://localhost:8443?ca=/missing.pem", err: true},
+		{raw: "tls://localhost:8443?cert=/missing.pem", err: true},
+	}
+
+	for _, test := range tests {
+		target, err := ParseTarget(test.raw)
+		if (err != nil) != test.err {
+			t.Fatalf("ParseTarget(%q) error %v", test.raw, err)
+		}
+
+		if test.err {
+			continue
+		}
+
+		if target.Network != test.network || target.Address != test.address || (target.TLS != nil) != test.tls || target.Host() != test.host {
+			t.Fatalf("ParseTarget(%q) = %s %s tls %v host %s", test.raw, target.Network, target.Address, target.TLS != nil, target.Host())
+		}
+
+		if target.String() != test.raw && target.String() != "tcp://"+test.raw {
+			t.Fatalf("ParseTarget(%q) is printed as %s", test.raw, target)
+		}
+	}
+
+	target, _ := ParseTarget("tls://localhost:8443?insecure=true")
+	if !target.TLS.InsecureSkipVerify {
+		t.Fatal("insecure=true is ignored")
+	}
+}
+
+func TestUnixTarget(t *testing.T) {
+	ctx := testContext(t)
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	go InitServiceTarget(ctx, "app", "token", "unix://"+socket, []ClientOption{
+		WithTopologyAddress(topology.URL()),
+	})
+
+	if err := gate.WaitConnected(ctx, "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := gate.Dial(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("got %q, %v from the unix socket", b, err)
+	}
+}
+
+func TestTLSTarget(t *testing.T) {
+	ctx := testContext(t)
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.TLS.ServerName))
+	}))
+	t.Cleanup(backend.Close)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+	if err := os.WriteFile(ca, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	// the test certificate is valid for example.com
+	target := "https://127.0.0.1:" + port + "?sni=example.com&ca=" + ca
+
+	gate := newTestGate(t)
+	topology := newTestTopology(t, pingetest.NewRegion("local", gate))
+
+	go InitServiceTarget(ctx, "app", "token", target, []ClientOption{
+		WithTopologyAddress(topology.URL()),
+		WithHTTP(HTTPOptions{RewriteHost: true}),
+	})
+
+	if err := gate.WaitConnected(ctx, "app", true); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := gate.HTTPClient("app").Get("http://" + gate.URI("app") + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	b, _ := io.ReadAll(res.Body)
+	if want := "example.com:" + port + " example.com"; string(b) != want {
+		t.Fatalf("backend got %q, want %q", b, want)
+	}
+
+	// an unknown ca fails the handshake
+	untrusted, _ := ParseTarget("https://127.0.0.1:" + port + "?sni=example.com")
+	if _, err := untrusted.Dial(ctx); err == nil {
+		t.Fatal("untrusted certificate is accepted")
+	}
+}
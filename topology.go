@@ -1,5 +1,7 @@
 package pinge
 
+import "time"
+
 type TopologyConfig struct {
 	Regions []TopologyRegion
 }
@@ -15,3 +17,10 @@ type TopologyGate struct {
 	PrimaryAddress   string `json:"primary_address"`
 	Busy             bool   `json:"-"`
 }
+
+type TopologyProbe struct {
+	Region   string        `json:"region"`
+	PingHost string        `json:"ping_host"`
+	RTT      time.Duration `json:"rtt"`
+	Error    string        `json:"error,omitempty"`
+}